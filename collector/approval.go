@@ -0,0 +1,212 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"collector/smartcontract/erc20"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// unlimitedAllowance is the smallest allowance treated as unlimited. Wallets approve
+// the max uint256 and some tokens cap allowances at the max uint96.
+var unlimitedAllowance = new(big.Int).Sub(new(big.Int).Lsh(common.Big1, 96), common.Big1)
+
+type ApprovalInfo struct {
+	Token           string `csv:"token"`
+	Symbol          string `csv:"symbol"`
+	Owner           string `csv:"owner"`
+	Spender         string `csv:"spender"`
+	Value           string `csv:"value"`
+	NormalizedValue string `csv:"normalized_value"`
+	Unlimited       bool   `csv:"unlimited"`
+	TxHash          string `csv:"tx_hash"`
+	BlockNumber     uint64 `csv:"block_number"`
+	EventID         uint16 `csv:"event_id"`
+}
+
+// AllowanceInfo is a row of the allowances report, the outstanding allowance of a
+// spender derived from the approvals report.
+type AllowanceInfo struct {
+	Token   string `csv:"token"`
+	Symbol  string `csv:"symbol"`
+	Owner   string `csv:"owner"`
+	Spender string `csv:"spender"`
+	// ApprovedValue is the value of the last approval, Allowance is the current one
+	// read from the token. They differ once the spender used a part of the approval.
+	ApprovedValue       string `csv:"approved_value"`
+	Allowance           string `csv:"allowance"`
+	NormalizedAllowance string `csv:"normalized_allowance"`
+	Unlimited           bool   `csv:"unlimited"`
+	BlockNumber         uint64 `csv:"block_number"`
+	TxHash              string `csv:"tx_hash"`
+}
+
+func (c *collectorService) collectApprovals() error {
+	log.WithField("from_block", c.fromBlock).
+		WithField("to_block", c.toBlock).
+		WithField("addresses", c.addresses).
+		Info("collect approvals")
+
+	approvalTopic := c.abi.Events["Approval"].ID
+
+	var queries []logsQuery
+	for _, batch := range c.addressBatches() {
+		queries = append(queries, logsQuery{topics: [][]common.Hash{{approvalTopic}, batch}})
+	}
+
+	return c.collectRanges(func(q ethereum.FilterQuery) ([]any, int, error) {
+		events, err := c.filterLogs(q, queries)
+		if err != nil || c.stopped() {
+			return nil, 0, err
+		}
+
+		sortLogs(events)
+
+		var result []any
+		for _, event := range events {
+			// ERC-721 approvals have the same signature but the token id is indexed
+			if len(event.Topics) == 3 {
+				result = append(result, event)
+			}
+		}
+
+		return result, len(events), nil
+	})
+}
+
+func (c *collectorService) convertApproval(eventRaw types.Log) (ApprovalInfo, bool) {
+	var event erc20.Erc20Approval
+	if err := unpackEvent(c.abi, "Approval", &event, &eventRaw); err != nil {
+		log.WithError(err).
+			WithField("tx_hash", eventRaw.TxHash.Hex()).
+			WithField("event_id", eventRaw.Index).
+			Error("parse approval event")
+		return ApprovalInfo{}, false
+	}
+
+	token, err := c.getTokenInfo(eventRaw.Address.Hex())
+	if err != nil {
+		log.WithError(err).
+			WithField("address", eventRaw.Address.Hex()).
+			Error("get token info")
+		return ApprovalInfo{}, false
+	}
+
+	return ApprovalInfo{
+		Token:           token.Address,
+		Symbol:          token.Symbol,
+		Owner:           event.Src.Hex(),
+		Spender:         event.Guy.Hex(),
+		Value:           event.Wad.String(),
+		NormalizedValue: Normalize(event.Wad, token.Decimals),
+		Unlimited:       event.Wad.Cmp(unlimitedAllowance) >= 0,
+		TxHash:          eventRaw.TxHash.Hex(),
+		BlockNumber:     eventRaw.BlockNumber,
+		EventID:         uint16(eventRaw.Index),
+	}, true
+}
+
+// allowancesFilePath returns the path of the allowances report next to the approvals one.
+func allowancesFilePath(cfg Config) string {
+	if cfg.AllowancesFilePath != "" {
+		return cfg.AllowancesFilePath
+	}
+	ext := filepath.Ext(cfg.OutputFilePath)
+	return strings.TrimSuffix(cfg.OutputFilePath, ext) + "_allowances" + ext
+}
+
+// writeAllowances replays the approvals report and writes the last approval of every
+// token, owner and spender whose allowance is not zero. The report is derived from
+// the whole approvals file, so it also covers approvals collected by earlier runs.
+func (c *collectorService) writeAllowances(approvalsPath, allowancesPath string) error {
+	var approvals []ApprovalInfo
+	if err := readRows(approvalsPath, c.outputFormat, &approvals); err != nil {
+		return fmt.Errorf("read approvals: %w", err)
+	}
+
+	last := make(map[string]ApprovalInfo)
+	for _, a := range approvals {
+		last[a.Token+a.Owner+a.Spender] = a
+	}
+
+	var result []AllowanceInfo
+	for _, a := range last {
+		approved, ok := new(big.Int).SetString(a.Value, 10)
+		if !ok {
+			log.WithField("tx_hash", a.TxHash).WithField("value", a.Value).Error("parse approval value")
+			continue
+		}
+
+		allowance, err := c.allowance(a.Token, a.Owner, a.Spender)
+		if err != nil {
+			log.WithError(err).
+				WithField("token", a.Token).
+				WithField("owner", a.Owner).
+				WithField("spender", a.Spender).
+				Warn("get allowance, use the approved value")
+			allowance = approved
+		}
+		if allowance.Sign() == 0 {
+			continue
+		}
+
+		decimals := uint8(18)
+		if token, err := c.getTokenInfo(a.Token); err == nil {
+			decimals = token.Decimals
+		}
+
+		result = append(result, AllowanceInfo{
+			Token:               a.Token,
+			Symbol:              a.Symbol,
+			Owner:               a.Owner,
+			Spender:             a.Spender,
+			ApprovedValue:       a.Value,
+			Allowance:           allowance.String(),
+			NormalizedAllowance: Normalize(allowance, decimals),
+			Unlimited:           allowance.Cmp(unlimitedAllowance) >= 0,
+			BlockNumber:         a.BlockNumber,
+			TxHash:              a.TxHash,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Token != b.Token {
+			return a.Token < b.Token
+		}
+		return a.Spender < b.Spender
+	})
+
+	if err := writeRowsFile(allowancesPath, c.outputFormat, result); err != nil {
+		return err
+	}
+
+	log.WithField("path", allowancesPath).WithField("allowances", len(result)).Info("allowances written")
+	return nil
+}
+
+func (c *collectorService) allowance(token, owner, spender string) (*big.Int, error) {
+	var allowance *big.Int
+	err := c.call("get allowance "+token, func(ctx context.Context, e *endpoint) (err error) {
+		caller, err := erc20.NewErc20Caller(common.HexToAddress(token), e.cli)
+		if err != nil {
+			return fmt.Errorf("bind token: %w", err)
+		}
+		allowance, err = caller.Allowance(&bind.CallOpts{Context: ctx}, common.HexToAddress(owner), common.HexToAddress(spender))
+		return err
+	})
+	return allowance, err
+}
@@ -0,0 +1,71 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Backend is the part of the node API the collector depends on. It is implemented
+// by ethclient.Client and can be replaced with a simulated chain or a fake.
+type Backend interface {
+	bind.ContractCaller
+
+	BlockNumber(ctx context.Context) (uint64, error)
+	ChainID(ctx context.Context) (*big.Int, error)
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	// BlockReceipts returns receipts of all txs of the block, see eth_getBlockReceipts.
+	BlockReceipts(ctx context.Context, number *big.Int) ([]*types.Receipt, error)
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+}
+
+// ethBackend adds the methods missing in ethclient.Client.
+type ethBackend struct {
+	*ethclient.Client
+	rpc *rpc.Client
+}
+
+func dialBackend(rawURL string) (ethBackend, error) {
+	cli, err := rpc.Dial(rawURL)
+	if err != nil {
+		return ethBackend{}, err
+	}
+	return ethBackend{Client: ethclient.NewClient(cli), rpc: cli}, nil
+}
+
+func (b ethBackend) BlockReceipts(ctx context.Context, number *big.Int) ([]*types.Receipt, error) {
+	var receipts []*types.Receipt
+	err := b.rpc.CallContext(ctx, &receipts, "eth_getBlockReceipts", hexutil.EncodeBig(number))
+	return receipts, err
+}
+
+func (b ethBackend) TraceBlockByNumber(ctx context.Context, number *big.Int) ([]json.RawMessage, error) {
+	var traces []json.RawMessage
+	err := b.rpc.CallContext(ctx, &traces, "debug_traceBlockByNumber", hexutil.EncodeBig(number),
+		map[string]string{"tracer": "callTracer"})
+	return traces, err
+}
+
+func (b ethBackend) TraceFilter(ctx context.Context, args TraceFilterArgs) ([]ParityTrace, error) {
+	var traces []ParityTrace
+	err := b.rpc.CallContext(ctx, &traces, "trace_filter", args)
+	return traces, err
+}
+
+func (b ethBackend) TraceTransaction(ctx context.Context, hash common.Hash) ([]ParityTrace, error) {
+	var traces []ParityTrace
+	err := b.rpc.CallContext(ctx, &traces, "trace_transaction", hash)
+	return traces, err
+}
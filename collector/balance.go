@@ -0,0 +1,255 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"collector/smartcontract/erc20"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	balanceKindTransfer = "transfer"
+	balanceKindCheck    = "check"
+)
+
+// BalanceInfo is a row of the balances report. Transfer rows hold the balance of the
+// holder right after the transfer, check rows compare the replayed balance with the
+// one read from the token at the end of a range.
+type BalanceInfo struct {
+	BlockNumber       uint64 `csv:"block_number"`
+	TxHash            string `csv:"tx_hash"`
+	EventID           uint16 `csv:"event_id"`
+	Kind              string `csv:"kind"`
+	Token             string `csv:"token"`
+	Symbol            string `csv:"symbol"`
+	Holder            string `csv:"holder"`
+	Change            string `csv:"change"`
+	Balance           string `csv:"balance"`
+	NormalizedBalance string `csv:"normalized_balance"`
+	OnChainBalance    string `csv:"on_chain_balance"`
+	// Mismatch is set when the on-chain balance differs from the replayed one, e.g. for
+	// fee-on-transfer or rebasing tokens.
+	Mismatch bool `csv:"mismatch"`
+}
+
+type balanceKey struct {
+	token  common.Address
+	holder common.Address
+}
+
+// collectBalances replays token transfers of the watched addresses into running
+// balances. Balances start from zero at the first block, so the range should begin
+// before the first transfer of the holders.
+func (c *collectorService) collectBalances() error {
+	log.WithField("from_block", c.fromBlock).
+		WithField("to_block", c.toBlock).
+		WithField("addresses", c.addresses).
+		Info("collect balances")
+
+	// the output is truncated to the checkpoint on resume and on reorganizations. Follow
+	// mode calls collect again while rows may still be buffered, the state is loaded once.
+	if c.balances == nil {
+		if err := c.loadBalances(); err != nil {
+			return fmt.Errorf("load balances: %w", err)
+		}
+		c.onRewind = c.loadBalances
+	}
+
+	fetchTransfers := c.transfersFetcher()
+	return c.collectRanges(func(q ethereum.FilterQuery) ([]any, int, error) {
+		transfers, logs, err := fetchTransfers(q)
+		if err != nil || c.stopped() {
+			return nil, 0, err
+		}
+
+		var (
+			result  []any
+			changed = make(map[balanceKey]struct{})
+		)
+		for _, t := range transfers {
+			event, ok := t.(types.Log)
+			if !ok {
+				continue
+			}
+
+			rows, err := c.replayTransfer(event)
+			if err != nil {
+				log.WithError(err).
+					WithField("tx_hash", event.TxHash.Hex()).
+					WithField("event_id", event.Index).
+					Error("replay transfer")
+				continue
+			}
+			for _, row := range rows {
+				changed[balanceKey{common.HexToAddress(row.Token), common.HexToAddress(row.Holder)}] = struct{}{}
+				result = append(result, row)
+			}
+		}
+
+		if c.balanceChecks {
+			checks, err := c.checkBalances(changed, q.ToBlock)
+			if err != nil {
+				return nil, 0, fmt.Errorf("check balances: %w", err)
+			}
+			result = append(result, checks...)
+		}
+
+		return result, logs, nil
+	})
+}
+
+// replayTransfer applies the transfer to the balances of watched holders.
+func (c *collectorService) replayTransfer(event types.Log) ([]*BalanceInfo, error) {
+	transfer, err := parseTransferEvent(c.abi, &event)
+	if err != nil {
+		return nil, fmt.Errorf("parse transfer event: %w", err)
+	}
+
+	token, err := c.getTokenInfo(event.Address.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("get token info: %w", err)
+	}
+
+	var rows []*BalanceInfo
+	for _, change := range []struct {
+		holder common.Address
+		value  *big.Int
+	}{
+		{transfer.Src, new(big.Int).Neg(transfer.Wad)},
+		{transfer.Dst, transfer.Wad},
+	} {
+		if !c.isWatched(change.holder) {
+			continue
+		}
+
+		key := balanceKey{event.Address, change.holder}
+		balance := new(big.Int).Add(c.balance(key), change.value)
+		c.balances[key] = balance
+
+		rows = append(rows, &BalanceInfo{
+			BlockNumber:       event.BlockNumber,
+			TxHash:            event.TxHash.Hex(),
+			EventID:           uint16(event.Index),
+			Kind:              balanceKindTransfer,
+			Token:             token.Address,
+			Symbol:            token.Symbol,
+			Holder:            change.holder.Hex(),
+			Change:            change.value.String(),
+			Balance:           balance.String(),
+			NormalizedBalance: Normalize(balance, token.Decimals),
+		})
+	}
+
+	return rows, nil
+}
+
+// checkBalances reads balances changed in the range at its last block. A mismatching
+// balance is replaced by the on-chain one, so the difference is reported only once.
+func (c *collectorService) checkBalances(changed map[balanceKey]struct{}, block *big.Int) ([]any, error) {
+	keys := make([]balanceKey, 0, len(changed))
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].holder != keys[j].holder {
+			return keys[i].holder.Hex() < keys[j].holder.Hex()
+		}
+		return keys[i].token.Hex() < keys[j].token.Hex()
+	})
+
+	var result []any
+	for _, key := range keys {
+		if c.stopped() {
+			return nil, nil
+		}
+
+		onChain, err := c.balanceOf(key, block)
+		if err != nil {
+			return nil, fmt.Errorf("get balance of %s in %s: %w", key.holder.Hex(), key.token.Hex(), err)
+		}
+
+		token, err := c.getTokenInfo(key.token.Hex())
+		if err != nil {
+			return nil, fmt.Errorf("get token info: %w", err)
+		}
+
+		balance := c.balance(key)
+		mismatch := balance.Cmp(onChain) != 0
+		if mismatch {
+			log.WithField("token", token.Address).
+				WithField("holder", key.holder.Hex()).
+				WithField("block", block).
+				WithField("balance", balance).
+				WithField("on_chain_balance", onChain).
+				Warn("replayed balance differs from on-chain one")
+			c.balances[key] = onChain
+		}
+
+		result = append(result, &BalanceInfo{
+			BlockNumber:       block.Uint64(),
+			Kind:              balanceKindCheck,
+			Token:             token.Address,
+			Symbol:            token.Symbol,
+			Holder:            key.holder.Hex(),
+			Balance:           balance.String(),
+			NormalizedBalance: Normalize(balance, token.Decimals),
+			OnChainBalance:    onChain.String(),
+			Mismatch:          mismatch,
+		})
+	}
+
+	return result, nil
+}
+
+// balanceOf needs an archive node for blocks older than the recent state.
+func (c *collectorService) balanceOf(key balanceKey, block *big.Int) (*big.Int, error) {
+	var balance *big.Int
+	err := c.call("get balance "+key.token.Hex(), func(ctx context.Context, e *endpoint) (err error) {
+		token, err := erc20.NewErc20Caller(key.token, e.cli)
+		if err != nil {
+			return fmt.Errorf("bind token: %w", err)
+		}
+		balance, err = token.BalanceOf(&bind.CallOpts{Context: ctx, BlockNumber: block}, key.holder)
+		return err
+	})
+	return balance, err
+}
+
+func (c *collectorService) balance(key balanceKey) *big.Int {
+	if balance, ok := c.balances[key]; ok {
+		return balance
+	}
+	return new(big.Int)
+}
+
+// loadBalances restores the running balances from the rows already in the output.
+func (c *collectorService) loadBalances() error {
+	c.balances = make(map[balanceKey]*big.Int)
+
+	var rows []BalanceInfo
+	if err := readRows(c.outputFilePath, c.outputFormat, &rows); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		value := row.Balance
+		if row.Kind == balanceKindCheck && row.OnChainBalance != "" {
+			value = row.OnChainBalance
+		}
+		balance, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return fmt.Errorf("parse balance %q of block %d", value, row.BlockNumber)
+		}
+		c.balances[balanceKey{common.HexToAddress(row.Token), common.HexToAddress(row.Holder)}] = balance
+	}
+
+	return nil
+}
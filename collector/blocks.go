@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const defaultWorkers = 1
+
+type blockResult struct {
+	num   uint64
+	block *types.Block
+	err   error
+}
+
+// fetchBlocks fetches blocks from..to with a pool of workers and returns them in order.
+// stop cancels the requests in flight and waits for the workers to exit.
+func (c *collectorService) fetchBlocks(from, to uint64) (blocks <-chan blockResult, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		workers = c.workers
+		done    = make(chan struct{})
+		nums    = make(chan uint64)
+		fetched = make(chan blockResult)
+		results = make(chan blockResult)
+		// limits the number of blocks fetched ahead of the first one not returned yet
+		inFlight = make(chan struct{}, 2*workers)
+	)
+
+	go func() {
+		defer close(nums)
+		for n := from; n <= to; n++ {
+			select {
+			case inFlight <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			select {
+			case nums <- n:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for n := range nums {
+				block, err := c.blockByNumber(ctx, new(big.Int).SetUint64(n))
+				select {
+				case fetched <- blockResult{num: n, block: block, err: err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(fetched)
+	}()
+
+	go func() {
+		defer close(results)
+
+		pending := make(map[uint64]blockResult)
+		next := from
+		for res := range fetched {
+			pending[res.num] = res
+			for r, ok := pending[next]; ok; r, ok = pending[next] {
+				delete(pending, next)
+				select {
+				case results <- r:
+				case <-done:
+					return
+				}
+				<-inFlight
+				next++
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			close(done)
+		})
+		for range results {
+		}
+		wg.Wait()
+	}
+
+	return results, stop
+}
+
+func (c *collectorService) blockByNumber(ctx context.Context, num *big.Int) (block *types.Block, err error) {
+	err = c.callContext(ctx, fmt.Sprintf("get block %d", num), func(ctx context.Context, e *endpoint) (err error) {
+		block, err = e.cli.BlockByNumber(ctx, num)
+		return err
+	})
+	return block, err
+}
@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFetchBlocksInOrder(t *testing.T) {
+	b := newFakeBackend(t, 100)
+	c := newTestService(b)
+	c.workers = 4
+
+	blocks, stop := c.fetchBlocks(10, 60)
+	defer stop()
+
+	next := uint64(10)
+	for res := range blocks {
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.num != next || res.block.NumberU64() != next {
+			t.Fatalf("got block %d, want %d", res.num, next)
+		}
+		next++
+	}
+	if next != 61 {
+		t.Errorf("fetched up to %d, want 60", next-1)
+	}
+}
+
+func TestFetchBlocksStop(t *testing.T) {
+	b := newFakeBackend(t, 100)
+	b.hold = make(chan struct{})
+	c := newTestService(b)
+	c.workers = 4
+
+	_, stop := c.fetchBlocks(0, 99)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop doesn't cancel the requests in flight")
+	}
+
+	b.mu.Lock()
+	calls := b.calledMethods["BlockByNumber"]
+	b.mu.Unlock()
+	if calls > 2*c.workers {
+		t.Errorf("%d blocks requested, want at most %d", calls, 2*c.workers)
+	}
+}
@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDataDir      = "./.data"
+	checkpointsFileName = "checkpoints.json"
+)
+
+// checkpoint is the last block whose rows are fully written to the output
+// and the size of the output file right after them.
+type checkpoint struct {
+	Block uint64 `json:"Block"`
+	Size  int64  `json:"Size"`
+}
+
+// checkpointMsg is sent to the csv service after all rows of the block are sent.
+type checkpointMsg uint64
+
+type checkpointStore struct {
+	mu          sync.Mutex
+	path        string
+	checkpoints map[string]checkpoint
+}
+
+func loadCheckpoints(dataDir string) (*checkpointStore, error) {
+	s := checkpointStore{path: filepath.Join(dataDir, checkpointsFileName), checkpoints: make(map[string]checkpoint)}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("read data file %s: %w", s.path, err)
+	}
+
+	if err := json.Unmarshal(data, &s.checkpoints); err != nil {
+		return nil, fmt.Errorf("unmarshal json: %w", err)
+	}
+
+	return &s, nil
+}
+
+func (s *checkpointStore) get(job string) (checkpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp, ok := s.checkpoints[job]
+	return cp, ok
+}
+
+func (s *checkpointStore) set(job string, cp checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[job] = cp
+	return s.save()
+}
+
+func (s *checkpointStore) delete(job string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.checkpoints, job)
+	return s.save()
+}
+
+func (s *checkpointStore) save() error {
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return fmt.Errorf("marshal json: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a broken state file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write file %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmpPath, err)
+	}
+
+	return nil
+}
+
+func jobKey(cfg Config) string {
+	mode, _ := cfg.mode()
+	var all []string
+	if cfg.Address != "" {
+		all = append(all, cfg.Address)
+	}
+	addresses := strings.Join(append(all, cfg.Addresses...), ",")
+	if mode == ModeEvents {
+		for _, e := range cfg.Events {
+			addresses += fmt.Sprintf(",%s:%s", e.Address, strings.Join(e.Events, "+"))
+		}
+	}
+	// the password of a connection string is not kept in the job
+	output := cfg.OutputFilePath
+	if u, err := url.Parse(output); err == nil && u.User != nil {
+		output = u.Redacted()
+	}
+	return fmt.Sprintf("%s|%s|%s", mode, addresses, output)
+}
+
+// resume continues the job from its checkpoint if the output file still holds
+// everything written before the checkpoint was made.
+func (c *collectorService) resume(outputConfig *OutputConfig) error {
+	if outputConfig.Format == OutputFormatPostgres {
+		block, ok, err := loadPostgresCheckpoint(outputConfig, c.job)
+		if err != nil || !ok {
+			return err
+		}
+		c.resumeFrom(block)
+		return nil
+	}
+
+	cp, ok := c.checkpoints.get(c.job)
+	if !ok {
+		return nil
+	}
+
+	if outputConfig.Format == OutputFormatParquet {
+		log.WithField("job", c.job).
+			WithField("block", cp.Block).
+			Warn("parquet output can't be appended, start from scratch")
+		return c.checkpoints.delete(c.job)
+	}
+
+	size, err := outputSize(outputConfig)
+	if err != nil || size < cp.Size {
+		log.WithField("job", c.job).
+			WithField("block", cp.Block).
+			Warn("output file does not match checkpoint, start from scratch")
+		return c.checkpoints.delete(c.job)
+	}
+
+	outputConfig.Append = true
+	outputConfig.Offset = cp.Size
+	c.resumeFrom(cp.Block)
+
+	return nil
+}
+
+// outputSize returns the size of the output file, or of all parts of a rotated output.
+func outputSize(outputConfig *OutputConfig) (int64, error) {
+	if outputConfig.Rotation.enabled() {
+		return rotatedSize(outputConfig.FilePath)
+	}
+
+	stat, err := os.Stat(outputConfig.FilePath)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (c *collectorService) resumeFrom(block uint64) {
+	next := new(big.Int).SetUint64(block + 1)
+	if next.Cmp(c.fromBlock) > 0 {
+		c.fromBlock = next
+	}
+
+	log.WithField("job", c.job).
+		WithField("block", block).
+		Info("resume from checkpoint")
+}
+
+func (c *collectorService) saveCheckpoint(cp checkpoint) {
+	if err := c.checkpoints.set(c.job, cp); err != nil {
+		log.WithError(err).WithField("block", cp.Block).Error("save checkpoint")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"math/big"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -15,54 +17,257 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	ModeTxs       = "txs"
+	ModeTransfers = "transfers"
+	ModeNFTs      = "nfts"
+	ModeEvents    = "events"
+	ModeApprovals = "approvals"
+	ModeBalances  = "balances"
 )
 
 type Config struct {
-	Url            string `yaml:"URL"`
-	Address        string `yaml:"Address"`
-	FromBlock      int64  `yaml:"FromBlock"`
-	ToBlock        int64  `yaml:"ToBlock"`
+	Url string `yaml:"URL"`
+	// Endpoints are used together with URL, calls are distributed between all of them.
+	Endpoints []EndpointConfig `yaml:"Endpoints"`
+	// MaxBlockLag is the number of blocks an endpoint may be behind the others before it is skipped.
+	MaxBlockLag         uint64        `yaml:"MaxBlockLag"`
+	HealthCheckInterval time.Duration `yaml:"HealthCheckInterval"`
+	Address             string        `yaml:"Address"`
+	Addresses           []string      `yaml:"Addresses"`
+	FromBlock           int64         `yaml:"FromBlock"`
+	ToBlock             int64         `yaml:"ToBlock"`
+	// Mode is "txs", "transfers", "nfts", "events", "approvals" or "balances".
+	// Transfers is the same as the "transfers" mode.
+	Mode           string `yaml:"Mode"`
 	Transfers      bool   `yaml:"Transfers"`
 	OutputFilePath string `yaml:"OutputFilePath"`
+	// OutputFormat is "csv", "jsonl", "parquet", "sqlite" or "postgres", by default it follows the
+	// extension of the output file. The tokens cache is kept in the SQLite database instead of
+	// tokens.json. The output file path of PostgreSQL is a connection string.
+	OutputFormat string `yaml:"OutputFormat"`
+	// ParquetRowGroupSize is the number of rows in a row group of the Parquet output.
+	ParquetRowGroupSize int `yaml:"ParquetRowGroupSize"`
+	// PostgresBatchSize is the number of rows copied to PostgreSQL in a transaction.
+	PostgresBatchSize int `yaml:"PostgresBatchSize"`
+	// Rotation splits csv and JSON Lines output into parts listed in a manifest file
+	// next to the output file, the output file itself is not written.
+	Rotation RotationConfig `yaml:"Rotation"`
+	// Events are decoded into the report in the "events" mode.
+	Events []EventsConfig `yaml:"Events"`
+	// AllowancesFilePath is the report of outstanding allowances in the "approvals" mode,
+	// it defaults to the output file name with the "_allowances" suffix.
+	AllowancesFilePath string `yaml:"AllowancesFilePath"`
+	// BalanceChecks compares replayed balances with balanceOf at the end of every range
+	// in the "balances" mode. Ranges far behind the head need an archive node.
+	BalanceChecks bool `yaml:"BalanceChecks"`
+
+	// NativeTransfers adds ETH moved by top-level txs to the ERC-20 transfers.
+	NativeTransfers bool `yaml:"NativeTransfers"`
+	// InternalTransfers adds ETH moved by calls inside txs to the ERC-20 transfers.
+	// TraceMethod is "debug" (default) or "trace_filter" depending on the node API.
+	InternalTransfers bool   `yaml:"InternalTransfers"`
+	TraceMethod       string `yaml:"TraceMethod"`
+
+	// Follow keeps collecting new blocks after ToBlock is reached until the program is stopped.
+	Follow       bool          `yaml:"Follow"`
+	PollInterval time.Duration `yaml:"PollInterval"`
+	// Workers is the number of blocks fetched concurrently.
+	Workers int `yaml:"Workers"`
+	// Confirmations is the number of blocks a block must be behind the head to be collected.
+	Confirmations uint64 `yaml:"Confirmations"`
+
+	Retry     RetryConfig     `yaml:"Retry"`
+	RateLimit RateLimitConfig `yaml:"RateLimit"`
+
+	// LogsBatchSize is the initial number of blocks in a logs query. The size is adjusted
+	// to the node limits during collection but never exceeds MaxLogsBatchSize.
+	LogsBatchSize    uint64 `yaml:"LogsBatchSize"`
+	MaxLogsBatchSize uint64 `yaml:"MaxLogsBatchSize"`
+
+	// DataDir keeps the checkpoints and the tokens cache, defaults to ./.data.
+	DataDir string `yaml:"DataDir"`
 }
 
 type tokenInfo struct {
-	Address    string `json:"Address"`
-	Symbol     string `json:"Symbol"`
-	Multiplier uint64 `json:"Multiplier"`
+	Address  string `json:"Address"`
+	Symbol   string `json:"Symbol"`
+	Decimals uint8  `json:"Decimals"`
+	// Multiplier is 10^Decimals, only read from caches written before Decimals was added.
+	Multiplier uint64 `json:"Multiplier,omitempty"`
 }
 
 type collectorService struct {
-	cli       *ethclient.Client
-	address   common.Address
+	mode      string
+	pool      *endpointPool
+	signer    types.Signer
+	addresses []common.Address
+	watched   map[common.Address]struct{}
 	abi       *abi.ABI
+	nftABIs   nftABIs
+	events    *eventSet
 	fromBlock *big.Int
 	toBlock   *big.Int
 	msgChan   chan<- any
 	done      chan struct{}
-	exitChan  chan os.Signal
+	quit      chan struct{}
+	cancel    context.CancelFunc
+	// outputErr is the error the output failed with, the run stops on it.
+	outputErr error
+
+	mu          sync.RWMutex
+	tokens      map[string]tokenInfo
+	collections map[string]collectionInfo
+
+	dataDir     string
+	job         string
+	checkpoints *checkpointStore
+
+	confirmations uint64
+	hashes        *blockHashes
+	// trackReorgs is set when the collected range reaches the chain head.
+	trackReorgs bool
+	// onRewind restores the state derived from the output after a rollback.
+	onRewind func() error
+
+	workers int
+	retry   RetryConfig
+	limiter *rate.Limiter
+
+	logsBatch    uint64
+	maxLogsBatch uint64
+
+	nativeTransfersOn   bool
+	internalTransfersOn bool
+	traceMethod         string
+
+	// noBlockReceipts is set once an endpoint does not support eth_getBlockReceipts.
+	noBlockReceipts bool
+
+	outputFilePath     string
+	outputFormat       string
+	rowGroupSize       int
+	batchSize          int
+	rotation           RotationConfig
+	allowancesFilePath string
 
-	mu     sync.RWMutex
-	tokens map[string]tokenInfo
+	balances      map[balanceKey]*big.Int
+	balanceChecks bool
 }
 
-func Run(cfg Config) (err error) {
-	c := collectorService{address: common.HexToAddress(cfg.Address)}
-	c.cli, err = ethclient.Dial(cfg.Url)
+// Run runs the collector until the block range is collected or the program
+// receives a stop signal.
+func Run(cfg Config) error {
+	pool, err := dialEndpoints(endpointConfigs(cfg), cfg.MaxBlockLag)
 	if err != nil {
-		return fmt.Errorf("dial eth client %s: %w", cfg.Url, err)
+		return fmt.Errorf("dial endpoints: %w", err)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	return run(ctx, cfg, pool)
+}
+
+// RunWithBackend runs the collector on top of the backend instead of the endpoints
+// from the config until the context is done. The backend is not closed on return.
+func RunWithBackend(ctx context.Context, cfg Config, backend Backend) error {
+	return run(ctx, cfg, newEndpointPool(&endpoint{name: "backend", cli: backend, weight: 1}))
+}
+
+// signalContext returns a context done once the program receives a stop signal.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func run(ctx context.Context, cfg Config, pool *endpointPool) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newCollectorService(ctx, cfg)
+
+	c.pool = pool
+	defer func() {
+		c.stop()
+		if outputErr := c.outputError(); outputErr != nil && err == nil {
+			err = fmt.Errorf("output: %w", outputErr)
+		}
+	}()
+
+	mode, err := cfg.mode()
+	if err != nil {
+		return err
+	}
+	c.mode = mode
+	c.outputFilePath = cfg.OutputFilePath
+	if c.outputFormat, err = outputFormat(cfg.OutputFormat, cfg.OutputFilePath); err != nil {
+		return err
+	}
+	if c.outputFormat != OutputFormatCSV && c.outputFormat != OutputFormatJSONL &&
+		(mode == ModeApprovals || mode == ModeBalances) {
+		// the reports are derived from the output read back while it is written
+		return fmt.Errorf("%s mode does not support %s output", mode, c.outputFormat)
+	}
+	if c.rotation.enabled() {
+		if c.outputFormat != OutputFormatCSV && c.outputFormat != OutputFormatJSONL {
+			return fmt.Errorf("rotation of %s output is not supported", c.outputFormat)
+		}
+		if mode == ModeApprovals || mode == ModeBalances {
+			return fmt.Errorf("%s mode does not support rotation", mode)
+		}
+	}
+	if mode == ModeBalances && (cfg.NativeTransfers || cfg.InternalTransfers) {
+		// ETH balances also change by fees which are not in the transfers
+		return fmt.Errorf("%s mode does not support native and internal transfers", mode)
+	}
+	if mode == ModeApprovals {
+		c.allowancesFilePath = allowancesFilePath(cfg)
+	}
+	if mode == ModeEvents {
+		if c.events, err = loadEvents(cfg.Events); err != nil {
+			return fmt.Errorf("load events: %w", err)
+		}
+	}
+
+	switch c.traceMethod {
+	case "":
+		c.traceMethod = TraceMethodDebug
+	case TraceMethodDebug, TraceMethodFilter:
+	default:
+		return fmt.Errorf("unknown trace method %q", c.traceMethod)
+	}
+
+	go c.pool.runHealthChecks(c, cfg.HealthCheckInterval)
+
+	if err := c.initSigner(); err != nil {
+		return fmt.Errorf("init signer: %w", err)
 	}
-	defer c.stop()
 
 	if err := c.initBlockRange(cfg.FromBlock, cfg.ToBlock); err != nil {
 		return fmt.Errorf("init block range: %w", err)
 	}
 
-	c.msgChan, err = runCsvService(c.newCsvConfig(cfg.OutputFilePath, cfg.Transfers))
+	c.checkpoints, err = loadCheckpoints(c.dataDir)
+	if err != nil {
+		return fmt.Errorf("load checkpoints: %w", err)
+	}
+	c.job = jobKey(cfg)
+
+	outputConfig := c.newOutputConfig(cfg.OutputFilePath, mode)
+	if err := c.resume(&outputConfig); err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+
+	c.msgChan, err = runOutputService(outputConfig)
 	if err != nil {
-		return fmt.Errorf("run csv service: %w", err)
+		return fmt.Errorf("run output service: %w", err)
+	}
+	if c.fromBlock.Sign() > 0 {
+		// a reorganization right at the start rolls back to here
+		c.msgChan <- checkpointMsg(c.fromBlock.Uint64() - 1)
 	}
 
 	c.abi, err = erc20.Erc20MetaData.GetAbi()
@@ -70,37 +275,207 @@ func Run(cfg Config) (err error) {
 		return fmt.Errorf("parse token abi: %w", err)
 	}
 
+	c.nftABIs, err = loadNFTABIs()
+	if err != nil {
+		return fmt.Errorf("parse nft abi: %w", err)
+	}
+
 	if err := c.initTokensInfo(); err != nil {
 		return fmt.Errorf("init tokens info: %w", err)
 	}
 
-	c.exitChan = make(chan os.Signal, 10)
-	signal.Notify(c.exitChan, os.Interrupt, syscall.SIGTERM, syscall.SIGKILL)
-
 	log.Info("init collector")
 
-	if cfg.Transfers {
-		return c.collectTransfers()
+	var collect func() error
+	switch mode {
+	case ModeTransfers:
+		collect = c.collectTransfers
+	case ModeNFTs:
+		collect = c.collectNFTTransfers
+	case ModeEvents:
+		collect = c.collectEvents
+	case ModeApprovals:
+		collect = c.collectApprovals
+	case ModeBalances:
+		collect = c.collectBalances
+	default:
+		collect = c.collectAllTxs
+	}
+
+	if err := collect(); err != nil {
+		return err
 	}
-	return c.collectAllTxs()
+
+	if cfg.Follow {
+		return c.follow(collect, cfg.PollInterval)
+	}
+	return nil
 }
 
-func (c *collectorService) stop() {
-	const wait = time.Second
+// newCollectorService applies defaults of the config. The collector stops once the context is done.
+func newCollectorService(ctx context.Context, cfg Config) *collectorService {
+	c := &collectorService{
+		dataDir:             cfg.DataDir,
+		collections:         make(map[string]collectionInfo),
+		confirmations:       cfg.Confirmations,
+		hashes:              newBlockHashes(),
+		trackReorgs:         cfg.ToBlock < 0 || cfg.Follow,
+		workers:             cfg.Workers,
+		nativeTransfersOn:   cfg.NativeTransfers,
+		internalTransfersOn: cfg.InternalTransfers,
+		traceMethod:         cfg.TraceMethod,
+		retry:               cfg.Retry,
+		limiter:             newRateLimiter(cfg.RateLimit),
+		logsBatch:           cfg.LogsBatchSize,
+		maxLogsBatch:        cfg.MaxLogsBatchSize,
+		balanceChecks:       cfg.BalanceChecks,
+		rowGroupSize:        cfg.ParquetRowGroupSize,
+		batchSize:           cfg.PostgresBatchSize,
+		rotation:            cfg.Rotation,
+	}
+	if c.logsBatch == 0 {
+		c.logsBatch = defaultLogsBatchSize
+	}
+	if c.maxLogsBatch == 0 {
+		c.maxLogsBatch = defaultMaxLogsBatchSize
+	}
+	if c.maxLogsBatch < c.logsBatch {
+		c.maxLogsBatch = c.logsBatch
+	}
+	c.retry.setDefaults()
+	if c.workers <= 0 {
+		c.workers = defaultWorkers
+	}
+	c.initAddresses(cfg)
 
-	if c.cli != nil {
-		c.cli.Close()
+	if c.dataDir == "" {
+		c.dataDir = defaultDataDir
 	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.quit = make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(c.quit)
+	}()
+
+	return c
+}
+
+func (c *collectorService) stop() {
 	if c.msgChan != nil {
 		close(c.msgChan)
+		<-c.done
+
+		// the report is derived from the written approvals and reads current allowances
+		if c.mode == ModeApprovals && c.tokens != nil {
+			if err := c.writeAllowances(c.outputFilePath, c.allowancesFilePath); err != nil {
+				log.WithError(err).Error("failed to write allowances")
+			}
+		}
+	}
+	if c.pool != nil {
+		c.pool.close()
 	}
 
-	<-c.done
+	// the cache is not loaded if the run fails early, saving it would wipe the file
+	if c.tokens != nil {
+		if err := c.saveTokensInfo(); err != nil {
+			log.WithError(err).Error("failed to save tokens info")
+		}
+	}
+}
+
+func (cfg Config) mode() (string, error) {
+	switch cfg.Mode {
+	case "":
+		if cfg.Transfers {
+			return ModeTransfers, nil
+		}
+		return ModeTxs, nil
+	case ModeTxs, ModeTransfers, ModeNFTs, ModeEvents, ModeApprovals, ModeBalances:
+		return cfg.Mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+}
+
+func endpointConfigs(cfg Config) []EndpointConfig {
+	var cfgs []EndpointConfig
+	if cfg.Url != "" {
+		cfgs = append(cfgs, EndpointConfig{Url: cfg.Url})
+	}
+	return append(cfgs, cfg.Endpoints...)
+}
+
+func (c *collectorService) initAddresses(cfg Config) {
+	c.watched = make(map[common.Address]struct{})
+	for _, a := range append([]string{cfg.Address}, cfg.Addresses...) {
+		if a == "" {
+			continue
+		}
 
-	if err := c.saveTokensInfo(); err != nil {
-		log.WithError(err).Error("failed to save tokens info")
+		address := common.HexToAddress(a)
+		if _, ok := c.watched[address]; !ok {
+			c.watched[address] = struct{}{}
+			c.addresses = append(c.addresses, address)
+		}
 	}
-	time.Sleep(wait)
+}
+
+func (c *collectorService) isWatched(address common.Address) bool {
+	_, ok := c.watched[address]
+	return ok
+}
+
+// matchedAddresses returns the watched ones of the addresses joined by commas.
+func (c *collectorService) matchedAddresses(addresses ...common.Address) string {
+	var matched []string
+	for _, a := range addresses {
+		if c.isWatched(a) && !containsString(matched, a.Hex()) {
+			matched = append(matched, a.Hex())
+		}
+	}
+	return strings.Join(matched, ",")
+}
+
+// outputFailed stops the collector once the output fails.
+func (c *collectorService) outputFailed(err error) {
+	c.mu.Lock()
+	c.outputErr = err
+	c.mu.Unlock()
+
+	c.cancel()
+}
+
+func (c *collectorService) outputError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.outputErr
+}
+
+// stopped reports whether the program received a stop signal or the output failed.
+func (c *collectorService) stopped() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *collectorService) initSigner() error {
+	var chainID *big.Int
+	err := c.call("get chain id", func(ctx context.Context, e *endpoint) (err error) {
+		chainID, err = e.cli.ChainID(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("get chain id: %w", err)
+	}
+
+	c.signer = types.LatestSignerForChainID(chainID)
+	return nil
 }
 
 func (c *collectorService) initBlockRange(fromBlock, toBlock int64) error {
@@ -113,38 +488,89 @@ func (c *collectorService) initBlockRange(fromBlock, toBlock int64) error {
 	if toBlock >= 0 {
 		c.toBlock = big.NewInt(toBlock)
 	} else {
-		blockNum, err := c.cli.BlockNumber(context.Background())
+		var blockNum uint64
+		err := c.call("get last block", func(ctx context.Context, e *endpoint) (err error) {
+			blockNum, err = e.cli.BlockNumber(ctx)
+			return err
+		})
 		if err != nil {
 			return fmt.Errorf("get last block: %w", err)
 		}
-		c.toBlock = big.NewInt(int64(blockNum))
+		c.toBlock = new(big.Int).SetUint64(c.confirmed(blockNum))
 	}
 
 	return nil
 }
 
-func (c *collectorService) newCsvConfig(filePath string, transfers bool) CsvConfig {
+// confirmed returns the last block with enough confirmations.
+func (c *collectorService) confirmed(head uint64) uint64 {
+	if head < c.confirmations {
+		return 0
+	}
+	return head - c.confirmations
+}
+
+func (c *collectorService) newOutputConfig(filePath, mode string) OutputConfig {
 	c.done = make(chan struct{})
 
-	csvConfig := CsvConfig{
+	outputConfig := OutputConfig{
 		FilePath:     filePath,
+		Format:       c.outputFormat,
+		RowGroupSize: c.rowGroupSize,
+		BatchSize:    c.batchSize,
+		Job:          c.job,
+		Rotation:     c.rotation,
 		FlushOnWrite: true,
 		Done:         c.done,
+		OnCheckpoint: c.saveCheckpoint,
+		OnError:      c.outputFailed,
+	}
+	if c.outputFormat == OutputFormatPostgres {
+		// checkpoints are committed with the rows
+		outputConfig.OnCheckpoint = nil
+	}
+	if c.rotation.Daily {
+		outputConfig.BlockTime = c.blockTime
 	}
 
-	if transfers {
-		csvConfig.InType = &types.Log{}
-		csvConfig.OutType = TransferInfo{}
-		csvConfig.Converter = func(val any) (any, bool) {
-			return c.convertToTransferInfo(val.(types.Log))
+	switch mode {
+	case ModeTransfers:
+		outputConfig.InType = &types.Log{}
+		outputConfig.OutType = TransferInfo{}
+		outputConfig.Converter = func(val any) (any, bool) {
+			return c.convertTransfer(val)
 		}
-	} else {
-		csvConfig.InType = &TxWrapper{}
-		csvConfig.OutType = TransactionInfo{}
-		csvConfig.Converter = func(val any) (any, bool) {
+	case ModeNFTs:
+		outputConfig.InType = &NFTTransfer{}
+		outputConfig.OutType = NFTTransferInfo{}
+		outputConfig.Converter = func(val any) (any, bool) {
+			return c.convertNFTTransfer(val.(*NFTTransfer))
+		}
+	case ModeBalances:
+		outputConfig.InType = &BalanceInfo{}
+		outputConfig.OutType = BalanceInfo{}
+		outputConfig.Converter = func(val any) (any, bool) {
+			return *val.(*BalanceInfo), true
+		}
+	case ModeApprovals:
+		outputConfig.InType = &types.Log{}
+		outputConfig.OutType = ApprovalInfo{}
+		outputConfig.Converter = func(val any) (any, bool) {
+			return c.convertApproval(val.(types.Log))
+		}
+	case ModeEvents:
+		outputConfig.InType = &EventLog{}
+		outputConfig.OutType = reflect.Zero(c.events.rowType).Interface()
+		outputConfig.Converter = func(val any) (any, bool) {
+			return c.convertEventLog(val.(*EventLog))
+		}
+	default:
+		outputConfig.InType = &TxWrapper{}
+		outputConfig.OutType = TransactionInfo{}
+		outputConfig.Converter = func(val any) (any, bool) {
 			return c.convertToTxInfo(val.(*TxWrapper))
 		}
 	}
 
-	return csvConfig
+	return outputConfig
 }
@@ -0,0 +1,249 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"collector/smartcontract/erc20"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testConfig returns a config writing the output and the data files to a temporary directory.
+func testConfig(t *testing.T, output string) Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	return Config{
+		OutputFilePath: filepath.Join(dir, output),
+		DataDir:        filepath.Join(dir, "data"),
+	}
+}
+
+func transferLog(t *testing.T, token, from, to common.Address, value int64) *types.Log {
+	t.Helper()
+
+	tokenABI, err := erc20.Erc20MetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Log{
+		Address: token,
+		Topics:  []common.Hash{tokenABI.Events["Transfer"].ID, from.Hash(), to.Hash()},
+		Data:    common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+	}
+}
+
+func TestRunTxsCSV(t *testing.T) {
+	watchedKey, otherKey := mustKey(t), mustKey(t)
+	watched, other := crypto.PubkeyToAddress(watchedKey.PublicKey), crypto.PubkeyToAddress(otherKey.PublicKey)
+	unrelated := common.HexToAddress("0x1234")
+
+	b := newFakeBackend(t, 0)
+	for i := 0; i < 20; i++ {
+		var txs []fakeTx
+		switch i {
+		case 3:
+			txs = []fakeTx{{key: watchedKey, to: &other, value: 100}}
+		case 5:
+			txs = []fakeTx{{key: otherKey, to: &unrelated, value: 1}, {key: otherKey, to: &watched, value: 200, nonce: 1, failed: true}}
+		case 7:
+			txs = []fakeTx{{key: otherKey, to: &unrelated, value: 300, nonce: 2}}
+		case 12:
+			txs = []fakeTx{{key: watchedKey, nonce: 1}}
+		}
+		b.addBlock(txs)
+	}
+
+	cfg := testConfig(t, "txs.csv")
+	cfg.Address = watched.Hex()
+	cfg.ToBlock = 10
+	cfg.Workers = 3
+	if err := RunWithBackend(context.Background(), cfg, b); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []TransactionInfo
+	if err := readRows(cfg.OutputFilePath, OutputFormatCSV, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	want := []TransactionInfo{
+		{Sender: watched.Hex(), Receiver: other.Hex(), BlockNumber: 3, Value: "100", Status: 1},
+		{Sender: other.Hex(), Receiver: watched.Hex(), BlockNumber: 5, Value: "200", Status: 0},
+	}
+	for i, w := range want {
+		r := rows[i]
+		if r.Sender != w.Sender || r.Receiver != w.Receiver || r.BlockNumber != w.BlockNumber ||
+			r.Value != w.Value || r.Status != w.Status || r.Watched != watched.Hex() {
+			t.Errorf("row %d = %+v, want %+v", i, r, w)
+		}
+		if r.GasUsed != 21000 || r.Fee != "63000000000000" || r.BaseFee != "1000000000" || r.PriorityFee != "2000000000" {
+			t.Errorf("row %d has fees %d %s %s %s", i, r.GasUsed, r.Fee, r.BaseFee, r.PriorityFee)
+		}
+	}
+
+	// the next run resumes from the checkpoint of the first one
+	cfg.ToBlock = 15
+	if err := RunWithBackend(context.Background(), cfg, b); err != nil {
+		t.Fatal(err)
+	}
+
+	rows = nil
+	if err := readRows(cfg.OutputFilePath, OutputFormatCSV, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows after resume, want 3", len(rows))
+	}
+	created := crypto.CreateAddress(watched, 1)
+	if r := rows[2]; r.BlockNumber != 12 || r.Receiver != "" || r.CreatedContract != created.Hex() {
+		t.Errorf("contract creation row = %+v", r)
+	}
+}
+
+func TestRunTransfersCSV(t *testing.T) {
+	key := mustKey(t)
+	watched, other := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+	watched2, unrelated := common.HexToAddress("0xc"), common.HexToAddress("0xd")
+	token := common.HexToAddress("0x70")
+
+	b := newFakeBackend(t, 0)
+	tokenABI, err := erc20.Erc20MetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setCall(token, tokenABI, "symbol", "TKN")
+	b.setCall(token, tokenABI, "decimals", uint8(6))
+
+	for i := 0; i < 30; i++ {
+		var logs []*types.Log
+		switch i {
+		case 2:
+			logs = []*types.Log{transferLog(t, token, watched, other, 1_234_567)}
+		case 9:
+			logs = []*types.Log{
+				transferLog(t, token, other, unrelated, 5),
+				transferLog(t, token, other, watched, 1_000_000),
+			}
+		case 20:
+			logs = []*types.Log{transferLog(t, token, watched, watched2, 1)}
+		}
+
+		var txs []fakeTx
+		if logs != nil {
+			txs = []fakeTx{{key: key, to: &token, nonce: uint64(i), logs: logs}}
+		}
+		b.addBlock(txs)
+	}
+
+	cfg := testConfig(t, "transfers.csv")
+	cfg.Addresses = []string{watched.Hex(), watched2.Hex()}
+	cfg.Mode = ModeTransfers
+	cfg.ToBlock = 29
+	cfg.LogsBatchSize = 4
+	if err := RunWithBackend(context.Background(), cfg, b); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []TransferInfo
+	if err := readRows(cfg.OutputFilePath, OutputFormatCSV, &rows); err != nil {
+		t.Fatal(err)
+	}
+	want := []TransferInfo{
+		{From: watched.Hex(), To: other.Hex(), Value: "1234567", NormalizedValue: "1.234567", BlockNumber: 2, Watched: watched.Hex()},
+		{From: other.Hex(), To: watched.Hex(), Value: "1000000", NormalizedValue: "1", BlockNumber: 9, EventID: 1, Watched: watched.Hex()},
+		{From: watched.Hex(), To: watched2.Hex(), Value: "1", NormalizedValue: "0.000001", BlockNumber: 20, Watched: watched.Hex() + "," + watched2.Hex()},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d: %+v", len(rows), len(want), rows)
+	}
+	for i, w := range want {
+		w.Token, w.Symbol, w.Kind = token.Hex(), "TKN", transferKindToken
+		w.TxHash = rows[i].TxHash
+		if rows[i] != w {
+			t.Errorf("row %d = %+v, want %+v", i, rows[i], w)
+		}
+	}
+}
+
+func TestRunKeepsTokensOnEarlyFailure(t *testing.T) {
+	cfg := testConfig(t, "transfers.csv")
+	cfg.Mode = "unknown"
+
+	path := filepath.Join(cfg.DataDir, tokensFileName)
+	if err := os.MkdirAll(cfg.DataDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`[{"Address":"0x70","Symbol":"TKN","Decimals":6}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunWithBackend(context.Background(), cfg, newFakeBackend(t, 1)); err == nil {
+		t.Fatal("run with an unknown mode succeeded")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "TKN") {
+		t.Errorf("tokens cache is overwritten with %s", data)
+	}
+}
+
+func TestRunRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		modify func(cfg *Config)
+	}{
+		{"balances with native transfers", "balances.csv", func(cfg *Config) {
+			cfg.Mode, cfg.NativeTransfers = ModeBalances, true
+		}},
+		{"balances with internal transfers", "balances.csv", func(cfg *Config) {
+			cfg.Mode, cfg.InternalTransfers = ModeBalances, true
+		}},
+		{"balances to parquet", "balances.parquet", func(cfg *Config) {
+			cfg.Mode = ModeBalances
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.output)
+			cfg.Address = common.HexToAddress("0xa").Hex()
+			tt.modify(&cfg)
+
+			if err := RunWithBackend(context.Background(), cfg, newFakeBackend(t, 1)); err == nil {
+				t.Fatal("run succeeded")
+			}
+			if _, err := os.Stat(cfg.OutputFilePath); !os.IsNotExist(err) {
+				t.Errorf("output is created: %v", err)
+			}
+		})
+	}
+}
+
+func TestOutputFailedStopsCollector(t *testing.T) {
+	c := newCollectorService(context.Background(), testConfig(t, "txs.csv"))
+	c.outputFailed(errors.New("disk full"))
+
+	select {
+	case <-c.quit:
+	case <-time.After(time.Second):
+		t.Fatal("collector is not stopped")
+	}
+	if err := c.outputError(); err == nil {
+		t.Error("output error is lost")
+	}
+}
@@ -1,114 +1,88 @@
 package collector
 
 import (
-	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
 
 	"github.com/jszwec/csvutil"
-	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
 )
 
-const bufferSize = 256
-
-type CsvConfig struct {
-	FilePath     string
-	FlushOnWrite bool
-	InType       any
-	OutType      any
-	Converter    func(in any) (any, bool)
-	Done         chan<- struct{}
+type csvSink struct {
+	*outputFile
+	encoder *csvutil.Encoder
 }
 
-func runCsvService(cfg CsvConfig) (chan<- any, error) {
-	if err := os.MkdirAll(filepath.Dir(cfg.FilePath), os.ModePerm); err != nil {
-		return nil, errors.Wrap(err, "cannot create statistics directory")
-	}
-
-	msgType := reflect.TypeOf(cfg.InType)
-	w, err := newCsvWriter(msgType, &cfg)
-	if err != nil {
-		return nil, fmt.Errorf("new writer: %w", err)
-	}
-
-	msgChan := make(chan any, bufferSize)
-	go w.run(msgChan)
-
-	return msgChan, nil
+// newCsvSink writes the header before the first row if header is set, it is already
+// written if the file is not empty.
+func newCsvSink(file *outputFile, header bool) *csvSink {
+	s := csvSink{outputFile: file}
+	s.resetEncoder(header)
+	return &s
 }
 
-type csvWriter struct {
-	encoder      *csvutil.Encoder
-	writer       *bufio.Writer
-	outType      reflect.Type
-	converter    func(in interface{}) (any, bool)
-	file         *os.File
-	flushOnWrite bool
-	done         chan<- struct{}
+func (s *csvSink) resetEncoder(header bool) {
+	s.encoder = csvutil.NewEncoder(csv.NewWriter(s.writer))
+	s.encoder.AutoHeader = header
 }
 
-func newCsvWriter(msgType reflect.Type, cfg *CsvConfig) (w csvWriter, err error) {
-	w.flushOnWrite = cfg.FlushOnWrite
-
-	if cfg.OutType != nil {
-		w.outType = reflect.TypeOf(cfg.OutType)
-		if !msgType.ConvertibleTo(w.outType) {
-			if cfg.Converter != nil {
-				w.converter = cfg.Converter
-			} else {
-				return w, fmt.Errorf("type %s is not convertible to %s", msgType, w.outType)
-			}
-		}
-	}
+func (s *csvSink) write(row any) error {
+	return s.encoder.Encode(row)
+}
 
-	w.file, err = os.Create(cfg.FilePath)
-	if err != nil {
-		return w, fmt.Errorf("create file %s: %w", cfg.FilePath, err)
+func (s *csvSink) rewind(cp checkpoint) error {
+	if err := s.truncate(cp.Size); err != nil {
+		return err
 	}
 
-	w.writer = bufio.NewWriter(w.file)
-	w.encoder = csvutil.NewEncoder(csv.NewWriter(w.writer))
-	w.done = cfg.Done
-
-	return w, nil
+	s.resetEncoder(cp.Size == 0)
+	return nil
 }
 
-func (w *csvWriter) run(dataChan <-chan interface{}) {
-	for msg := range dataChan {
-		if w.converter != nil {
-			var ok bool
-			if msg, ok = w.converter(msg); !ok {
-				continue
-			}
-		} else if w.outType != nil {
-			msg = reflect.ValueOf(msg).Convert(w.outType).Interface()
-		}
-
-		if err := w.encoder.Encode(msg); err != nil {
-			log.WithError(err).Error("encode msg")
-		}
-
-		if w.flushOnWrite {
-			if err := w.writer.Flush(); err != nil {
-				log.WithError(err).Error("flush")
-			}
+func readCsvRows(r io.Reader, out any) error {
+	dec, err := csvutil.NewDecoder(csv.NewReader(r))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
 		}
+		return err
 	}
 
-	w.stop()
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
 }
 
-func (w *csvWriter) stop() {
-	if err := w.writer.Flush(); err != nil {
-		log.WithError(err).Error("flush")
+// writeCsvFile writes the rows to a new file at once, the header is written even if there are no rows.
+func writeCsvFile(path string, rows any) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	enc := csvutil.NewEncoder(w)
+	if v := reflect.ValueOf(rows); v.Len() == 0 {
+		err = enc.EncodeHeader(reflect.Zero(v.Type().Elem()).Interface())
+	} else {
+		err = enc.Encode(rows)
+	}
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
 	}
 
-	if err := w.file.Close(); err != nil {
-		log.WithError(err).Error("close file")
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("write file %s: %w", path, err)
 	}
-	w.done <- struct{}{}
+	return file.Close()
 }
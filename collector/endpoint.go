@@ -0,0 +1,242 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultMaxBlockLag         = 10
+	// failureCooldown is the time an endpoint is not used after a failed call.
+	failureCooldown = 30 * time.Second
+)
+
+type EndpointConfig struct {
+	Url string `yaml:"URL"`
+	// Weight is the share of calls sent to the endpoint, defaults to 1.
+	Weight int `yaml:"Weight"`
+}
+
+type endpoint struct {
+	url  string
+	name string
+	cli  Backend
+	// closer releases the connection, nil if the endpoint is owned by the caller
+	closer func()
+
+	weight        int
+	currentWeight int
+	head          uint64
+	lagging       bool
+	failedUntil   time.Time
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	return !e.lagging && now.After(e.failedUntil)
+}
+
+// endpointPool distributes calls between endpoints with smooth weighted round-robin
+// and skips endpoints that failed recently or lag behind the others.
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	maxLag    uint64
+}
+
+func dialEndpoints(cfgs []EndpointConfig, maxLag uint64) (*endpointPool, error) {
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+
+	if maxLag == 0 {
+		maxLag = defaultMaxBlockLag
+	}
+
+	p := newEndpointPool()
+	p.maxLag = maxLag
+	for _, cfg := range cfgs {
+		cli, err := dialBackend(cfg.Url)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("dial eth client %s: %w", endpointName(cfg.Url), err)
+		}
+
+		weight := cfg.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		p.endpoints = append(p.endpoints, &endpoint{
+			url:    cfg.Url,
+			name:   endpointName(cfg.Url),
+			cli:    cli,
+			closer: cli.Close,
+			weight: weight,
+		})
+	}
+
+	return p, nil
+}
+
+func newEndpointPool(endpoints ...*endpoint) *endpointPool {
+	return &endpointPool{endpoints: endpoints, maxLag: defaultMaxBlockLag}
+}
+
+// endpointName hides the path of the url that usually contains an access token.
+func endpointName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// next returns the endpoint for the next call, skipping the given ones. If all
+// endpoints are unhealthy it returns the one that failed the longest ago.
+func (p *endpointPool) next(skip map[*endpoint]struct{}) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		now         = time.Now()
+		best        *endpoint
+		totalWeight int
+	)
+	for _, e := range p.endpoints {
+		if _, ok := skip[e]; ok || !e.healthy(now) {
+			continue
+		}
+
+		e.currentWeight += e.weight
+		totalWeight += e.weight
+		if best == nil || e.currentWeight > best.currentWeight {
+			best = e
+		}
+	}
+
+	if best == nil {
+		for _, e := range p.endpoints {
+			if _, ok := skip[e]; ok {
+				continue
+			}
+			if best == nil || e.failedUntil.Before(best.failedUntil) {
+				best = e
+			}
+		}
+		return best
+	}
+
+	best.currentWeight -= totalWeight
+	return best
+}
+
+// hasOther reports whether some endpoint is not skipped.
+func (p *endpointPool) hasOther(skip map[*endpoint]struct{}) bool {
+	for _, e := range p.endpoints {
+		if _, ok := skip[e]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *endpointPool) markFailed(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.failedUntil = time.Now().Add(failureCooldown)
+}
+
+// checkHealth updates block heights of the endpoints and marks the lagging ones.
+func (p *endpointPool) checkHealth(c *collectorService) {
+	heads := make([]uint64, len(p.endpoints))
+	for i, e := range p.endpoints {
+		if err := c.limiter.Wait(context.Background()); err != nil {
+			return
+		}
+
+		head, err := e.cli.BlockNumber(context.Background())
+		if err != nil {
+			log.WithError(err).WithField("endpoint", e.name).Warn("endpoint health check failed")
+			p.markFailed(e)
+			continue
+		}
+		heads[i] = head
+	}
+
+	var maxHead uint64
+	for _, head := range heads {
+		if head > maxHead {
+			maxHead = head
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, e := range p.endpoints {
+		if heads[i] == 0 {
+			continue
+		}
+
+		lagging := heads[i]+p.maxLag < maxHead
+		if lagging && !e.lagging {
+			log.WithField("endpoint", e.name).
+				WithField("head", heads[i]).
+				WithField("max_head", maxHead).
+				Warn("endpoint lags behind")
+		}
+		e.head = heads[i]
+		e.lagging = lagging
+	}
+}
+
+func (p *endpointPool) runHealthChecks(c *collectorService, interval time.Duration) {
+	if len(p.endpoints) < 2 {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.checkHealth(c)
+
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribeNewHead subscribes to new heads on the first endpoint supporting subscriptions.
+func (p *endpointPool) subscribeNewHead(ctx context.Context, ch chan<- *types.Header) (sub ethereum.Subscription, err error) {
+	for _, e := range p.endpoints {
+		sub, err = e.cli.SubscribeNewHead(ctx, ch)
+		if err == nil {
+			log.WithField("endpoint", e.name).Info("subscribed to new heads")
+			return sub, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *endpointPool) close() {
+	for _, e := range p.endpoints {
+		if e.closer != nil {
+			e.closer()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+)
+
+func TestCallNotFoundOnLaggingEndpoint(t *testing.T) {
+	lagging, synced := newFakeBackend(t, 5), newFakeBackend(t, 10)
+	c := newTestService(lagging)
+	c.pool = newEndpointPool(
+		&endpoint{name: "lagging", cli: lagging, weight: 10},
+		&endpoint{name: "synced", cli: synced, weight: 1},
+	)
+
+	for i := 0; i < 5; i++ {
+		block, err := c.blockByNumber(context.Background(), big.NewInt(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.NumberU64() != 8 {
+			t.Fatalf("got block %d, want 8", block.NumberU64())
+		}
+	}
+
+	if _, err := c.blockByNumber(context.Background(), big.NewInt(20)); !errors.Is(err, ethereum.NotFound) {
+		t.Errorf("blockByNumber() error = %v, want not found", err)
+	}
+	for _, e := range c.pool.endpoints {
+		if !e.healthy(time.Now()) {
+			t.Errorf("endpoint %s is marked failed", e.name)
+		}
+	}
+}
+
+func TestCallMarksFailedOnLastAttempt(t *testing.T) {
+	b := newFakeBackend(t, 5)
+	b.fail = func(string, *big.Int) error {
+		return errors.New("503 service unavailable")
+	}
+	c := newTestService(b)
+	c.retry.MaxAttempts = 1
+
+	if _, err := c.blockByNumber(context.Background(), big.NewInt(1)); err == nil {
+		t.Fatal("blockByNumber() succeeded")
+	}
+	if e := c.pool.endpoints[0]; e.healthy(time.Now()) {
+		t.Error("endpoint isn't marked failed after the last attempt")
+	}
+}
+
+func TestEndpointPoolWeights(t *testing.T) {
+	a := &endpoint{name: "a", weight: 3}
+	b := &endpoint{name: "b", weight: 1}
+	p := newEndpointPool(a, b)
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[p.next(nil).name]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Errorf("calls %v, want a: 6, b: 2", counts)
+	}
+
+	skip := map[*endpoint]struct{}{a: {}}
+	if e := p.next(skip); e != b {
+		t.Errorf("next() = %s, want b", e.name)
+	}
+}
@@ -0,0 +1,387 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+type EventsConfig struct {
+	// Address is the contract emitting the events, logs of any contract are collected if empty.
+	Address string `yaml:"Address"`
+	// ABIFile is the path to the JSON ABI of the contract.
+	ABIFile string   `yaml:"ABIFile"`
+	Events  []string `yaml:"Events"`
+}
+
+// eventColumns are the columns of every row of the events report, the event
+// arguments are added after them.
+var eventColumns = []string{"contract", "event", "tx_hash", "block_number", "event_id"}
+
+// eventDef is a configured event and the report columns of its arguments.
+type eventDef struct {
+	address *common.Address
+	event   abi.Event
+	// columns are the indexes of the row fields holding the arguments.
+	columns []int
+	// indexed are the indexed arguments named by their position, names in
+	// an ABI may be empty or repeated.
+	indexed abi.Arguments
+}
+
+// eventSet is the configured events and the row type of the report built from
+// the arguments of all of them.
+type eventSet struct {
+	defs    []*eventDef
+	byTopic map[common.Hash][]*eventDef
+	rowType reflect.Type
+}
+
+// EventLog is a log matched by a configured event.
+type EventLog struct {
+	Log types.Log
+	def *eventDef
+}
+
+func loadEvents(cfgs []EventsConfig) (*eventSet, error) {
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no events configured")
+	}
+
+	s := eventSet{byTopic: make(map[common.Hash][]*eventDef)}
+	columns := append([]string(nil), eventColumns...)
+	columnIndex := make(map[string]int)
+	for i, name := range columns {
+		columnIndex[name] = i
+	}
+
+	for _, cfg := range cfgs {
+		data, err := os.ReadFile(cfg.ABIFile)
+		if err != nil {
+			return nil, fmt.Errorf("read abi file %s: %w", cfg.ABIFile, err)
+		}
+
+		contractABI, err := abi.JSON(strings.NewReader(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("parse abi file %s: %w", cfg.ABIFile, err)
+		}
+
+		var address *common.Address
+		if cfg.Address != "" {
+			a := common.HexToAddress(cfg.Address)
+			address = &a
+		}
+
+		if len(cfg.Events) == 0 {
+			return nil, fmt.Errorf("no events of %s configured", cfg.ABIFile)
+		}
+		for _, name := range cfg.Events {
+			event, ok := contractABI.Events[name]
+			if !ok {
+				return nil, fmt.Errorf("event %s not found in %s", name, cfg.ABIFile)
+			}
+			if event.Anonymous {
+				return nil, fmt.Errorf("anonymous event %s is not supported", name)
+			}
+
+			def := eventDef{address: address, event: event}
+			for j, arg := range event.Inputs {
+				// an argument whose name is repeated in the event gets its own column
+				base := argColumn(arg, j)
+				column, idx, ok := base, 0, false
+				for n := 2; ; n++ {
+					idx, ok = columnIndex[column]
+					if !ok || !containsInt(def.columns, idx) {
+						break
+					}
+					column = base + "_" + strconv.Itoa(n)
+				}
+				if !ok {
+					idx = len(columns)
+					columns = append(columns, column)
+					columnIndex[column] = idx
+				}
+				def.columns = append(def.columns, idx)
+
+				if arg.Indexed {
+					arg.Name = strconv.Itoa(j)
+					def.indexed = append(def.indexed, arg)
+				}
+			}
+
+			s.defs = append(s.defs, &def)
+			s.byTopic[event.ID] = append(s.byTopic[event.ID], &def)
+		}
+	}
+
+	// all arguments have the same type, so events sharing an argument name share the column
+	fields := make([]reflect.StructField, len(columns))
+	for i, column := range columns {
+		fields[i] = reflect.StructField{
+			Name: "F" + strconv.Itoa(i),
+			Type: reflect.TypeOf(eventArg{}),
+			Tag:  reflect.StructTag(fmt.Sprintf(`csv:"%s"`, column)),
+		}
+	}
+	fields[0].Type = reflect.TypeOf("")
+	fields[1].Type = reflect.TypeOf("")
+	fields[2].Type = reflect.TypeOf("")
+	fields[3].Type = reflect.TypeOf(uint64(0))
+	fields[4].Type = reflect.TypeOf(uint16(0))
+	s.rowType = reflect.StructOf(fields)
+
+	return &s, nil
+}
+
+func argColumn(arg abi.Argument, i int) string {
+	name := arg.Name
+	if name == "" {
+		name = "arg" + strconv.Itoa(i)
+	}
+	// the job column is added to the rows of database outputs
+	if name == jobColumn || containsString(eventColumns, name) {
+		return "arg_" + name
+	}
+	return name
+}
+
+// match returns the configured event of the log, the signature alone is ambiguous
+// as e.g. ERC-20 and ERC-721 transfers differ only in indexed arguments.
+func (s *eventSet) match(event *types.Log) *eventDef {
+	if len(event.Topics) == 0 {
+		return nil
+	}
+
+	for _, def := range s.byTopic[event.Topics[0]] {
+		if def.address != nil && *def.address != event.Address {
+			continue
+		}
+
+		indexed := 0
+		for _, arg := range def.event.Inputs {
+			if arg.Indexed {
+				indexed++
+			}
+		}
+		if len(event.Topics) == indexed+1 {
+			return def
+		}
+	}
+	return nil
+}
+
+func (c *collectorService) collectEvents() error {
+	log.WithField("from_block", c.fromBlock).
+		WithField("to_block", c.toBlock).
+		WithField("events", len(c.events.defs)).
+		Info("collect events")
+
+	// events of the same contract are fetched by a single query
+	var (
+		queries []logsQuery
+		byAddr  = make(map[common.Address]int)
+		anyAddr = -1
+	)
+	for _, def := range c.events.defs {
+		idx, ok := anyAddr, anyAddr >= 0
+		if def.address != nil {
+			idx, ok = byAddr[*def.address]
+		}
+		if !ok {
+			idx = len(queries)
+			q := logsQuery{topics: [][]common.Hash{nil}}
+			if def.address != nil {
+				q.addresses = []common.Address{*def.address}
+				byAddr[*def.address] = idx
+			} else {
+				anyAddr = idx
+			}
+			queries = append(queries, q)
+		}
+
+		topics := queries[idx].topics[0]
+		if !containsHash(topics, def.event.ID) {
+			queries[idx].topics[0] = append(topics, def.event.ID)
+		}
+	}
+
+	return c.collectRanges(func(q ethereum.FilterQuery) ([]any, int, error) {
+		events, err := c.filterLogs(q, queries)
+		if err != nil || c.stopped() {
+			return nil, 0, err
+		}
+
+		// a log of a contract may be returned by both its own query and the query by any contract
+		sortLogs(events)
+
+		var result []any
+		for i, event := range events {
+			if i > 0 && events[i-1].BlockNumber == event.BlockNumber && events[i-1].Index == event.Index {
+				continue
+			}
+			if def := c.events.match(&event); def != nil {
+				result = append(result, &EventLog{Log: event, def: def})
+			}
+		}
+
+		return result, len(events), nil
+	})
+}
+
+func (c *collectorService) convertEventLog(e *EventLog) (any, bool) {
+	// arguments are decoded by position, not by their names
+	values, err := e.def.event.Inputs.NonIndexed().Unpack(e.Log.Data)
+	if err != nil {
+		log.WithError(err).
+			WithField("tx_hash", e.Log.TxHash.Hex()).
+			WithField("event_id", e.Log.Index).
+			Error("unpack event")
+		return nil, false
+	}
+
+	topics := make(map[string]any)
+	if err := abi.ParseTopicsIntoMap(topics, e.def.indexed, e.Log.Topics[1:]); err != nil {
+		log.WithError(err).
+			WithField("tx_hash", e.Log.TxHash.Hex()).
+			WithField("event_id", e.Log.Index).
+			Error("parse event topics")
+		return nil, false
+	}
+
+	args := make([]any, len(e.def.event.Inputs))
+	for i, arg := range e.def.event.Inputs {
+		if arg.Indexed {
+			args[i] = topics[strconv.Itoa(i)]
+		} else {
+			args[i], values = values[0], values[1:]
+		}
+	}
+
+	row := reflect.New(c.events.rowType).Elem()
+	row.Field(0).SetString(e.Log.Address.Hex())
+	row.Field(1).SetString(e.def.event.Name)
+	row.Field(2).SetString(e.Log.TxHash.Hex())
+	row.Field(3).SetUint(e.Log.BlockNumber)
+	row.Field(4).SetUint(uint64(e.Log.Index))
+	for i, arg := range args {
+		row.Field(e.def.columns[i]).Set(reflect.ValueOf(eventArg{arg}))
+	}
+
+	return row.Interface(), true
+}
+
+// eventArg is a decoded event argument. It is a single csv cell, while JSON keeps
+// its structure with big numbers as strings.
+type eventArg struct {
+	value any
+}
+
+func (a eventArg) MarshalText() ([]byte, error) {
+	return []byte(formatArg(a.value)), nil
+}
+
+func (a eventArg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonArg(a.value))
+}
+
+// formatArg formats an event argument for a csv cell. Composite values are written as JSON.
+func formatArg(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case common.Address:
+		return v.Hex()
+	case common.Hash:
+		return v.Hex()
+	case *big.Int:
+		return v.String()
+	case []byte:
+		return hexutil.Encode(v)
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprint(v)
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return hexutil.Encode(b)
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// jsonArg converts an event argument to plain values for JSON.
+func jsonArg(v any) any {
+	switch v := v.(type) {
+	case nil, string, bool:
+		return v
+	case common.Address, common.Hash, *big.Int, []byte:
+		return formatArg(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v
+	case reflect.Array, reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return formatArg(v)
+		}
+		items := make([]any, rv.Len())
+		for i := range items {
+			items[i] = jsonArg(rv.Index(i).Interface())
+		}
+		return items
+	case reflect.Struct:
+		// tuples are structs with the argument names in json tags
+		fields := make(map[string]any, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			f := rv.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = jsonArg(rv.Field(i).Interface())
+		}
+		return fields
+	}
+
+	return formatArg(v)
+}
+
+func containsHash(hashes []common.Hash, h common.Hash) bool {
+	for _, x := range hashes {
+		if x == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const swapABI = `[{"type":"event","name":"Swap","anonymous":false,"inputs":[
+	{"name":"","type":"address","indexed":true},
+	{"name":"","type":"uint256","indexed":false},
+	{"name":"amount","type":"uint256","indexed":false},
+	{"name":"amount","type":"uint256","indexed":true},
+	{"name":"arg1","type":"uint256","indexed":false}
+]}]`
+
+func TestConvertEventLogPositional(t *testing.T) {
+	abiFile := filepath.Join(t.TempDir(), "swap.abi")
+	if err := os.WriteFile(abiFile, []byte(swapABI), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := loadEvents([]EventsConfig{{ABIFile: abiFile, Events: []string{"Swap"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestService(newFakeBackend(t, 1))
+	c.events = events
+
+	sender := common.HexToAddress("0xa")
+	var data []byte
+	for _, v := range []int64{1, 2, 4} {
+		data = append(data, common.LeftPadBytes(big.NewInt(v).Bytes(), 32)...)
+	}
+	l := types.Log{
+		Address: common.HexToAddress("0x5"),
+		Topics:  []common.Hash{events.defs[0].event.ID, sender.Hash(), common.BigToHash(big.NewInt(3))},
+		Data:    data,
+	}
+	def := events.match(&l)
+	if def == nil {
+		t.Fatal("log doesn't match the event")
+	}
+
+	row, ok := c.convertEventLog(&EventLog{Log: l, def: def})
+	if !ok {
+		t.Fatal("convertEventLog() failed")
+	}
+
+	got := make(map[string]string)
+	rv := reflect.ValueOf(row)
+	for i := 0; i < rv.NumField(); i++ {
+		if arg, ok := rv.Field(i).Interface().(eventArg); ok {
+			got[rv.Type().Field(i).Tag.Get("csv")] = formatArg(arg.value)
+		}
+	}
+	want := map[string]string{
+		"arg0":     sender.Hex(),
+		"arg1":     "1",
+		"amount":   "2",
+		"amount_2": "3",
+		"arg1_2":   "4",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+}
+
+func TestArgColumn(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", "arg3"},
+		{"amount", "amount"},
+		{"tx_hash", "arg_tx_hash"},
+		{"job", "arg_job"},
+	}
+	for _, tt := range tests {
+		if got := argColumn(abi.Argument{Name: tt.name}, 3); got != tt.want {
+			t.Errorf("argColumn(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
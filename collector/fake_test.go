@@ -0,0 +1,407 @@
+package collector
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// fakeBackend is an in-memory chain for tests. Blocks are appended with addBlock,
+// fork replaces the tail of the chain.
+type fakeBackend struct {
+	mu       sync.Mutex
+	chainID  *big.Int
+	blocks   []*types.Block
+	receipts map[common.Hash][]*types.Receipt
+	balances map[common.Address]*big.Int
+	calls    map[fakeCallKey][]byte
+	// fail returns an error for a call of the method, nil by default.
+	fail func(method string, number *big.Int) error
+	// hold blocks BlockByNumber calls until it is closed or the call is cancelled.
+	hold chan struct{}
+	// blockReceipts alters the response of BlockReceipts.
+	blockReceipts func(receipts []*types.Receipt) []*types.Receipt
+	// calledMethods counts calls by method name.
+	calledMethods map[string]int
+}
+
+type fakeCallKey struct {
+	to       common.Address
+	selector [4]byte
+}
+
+var _ Backend = (*fakeBackend)(nil)
+
+func newFakeBackend(t *testing.T, blocks int) *fakeBackend {
+	t.Helper()
+
+	b := &fakeBackend{
+		chainID:       big.NewInt(1337),
+		receipts:      make(map[common.Hash][]*types.Receipt),
+		balances:      make(map[common.Address]*big.Int),
+		calls:         make(map[fakeCallKey][]byte),
+		calledMethods: make(map[string]int),
+	}
+	for i := 0; i < blocks; i++ {
+		b.addBlock(nil)
+	}
+	return b
+}
+
+// fakeTx is a tx of a block built by the fake backend, logs are emitted by its receipt.
+type fakeTx struct {
+	key    *ecdsa.PrivateKey
+	to     *common.Address
+	value  int64
+	nonce  uint64
+	logs   []*types.Log
+	failed bool
+}
+
+// addBlock appends a block with the txs to the chain.
+func (b *fakeBackend) addBlock(txs []fakeTx) *types.Block {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.appendBlock(txs, nil)
+}
+
+// fork drops the blocks from the block on and appends the same number of blocks
+// with different hashes.
+func (b *fakeBackend) fork(from uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.blocks) - int(from)
+	b.blocks = b.blocks[:from]
+	for i := 0; i < n; i++ {
+		b.appendBlock(nil, []byte("fork"))
+	}
+}
+
+func (b *fakeBackend) appendBlock(txs []fakeTx, extra []byte) *types.Block {
+	signer := types.LatestSignerForChainID(b.chainID)
+	number := uint64(len(b.blocks))
+	header := &types.Header{
+		Number:   new(big.Int).SetUint64(number),
+		Time:     1_700_000_000 + 12*number,
+		GasLimit: 30_000_000,
+		BaseFee:  big.NewInt(1_000_000_000),
+		Extra:    extra,
+	}
+	if number > 0 {
+		header.ParentHash = b.blocks[number-1].Hash()
+	}
+
+	var (
+		signed   []*types.Transaction
+		receipts []*types.Receipt
+		logIndex uint
+	)
+	for i, ftx := range txs {
+		tx, err := types.SignNewTx(ftx.key, signer, &types.DynamicFeeTx{
+			ChainID:   b.chainID,
+			Nonce:     ftx.nonce,
+			GasTipCap: big.NewInt(2_000_000_000),
+			GasFeeCap: big.NewInt(3_000_000_000),
+			Gas:       100_000,
+			To:        ftx.to,
+			Value:     big.NewInt(ftx.value),
+		})
+		if err != nil {
+			panic(err)
+		}
+		signed = append(signed, tx)
+
+		receipt := &types.Receipt{
+			Type:              tx.Type(),
+			Status:            types.ReceiptStatusSuccessful,
+			GasUsed:           21_000,
+			CumulativeGasUsed: 21_000 * uint64(i+1),
+			TxHash:            tx.Hash(),
+			TransactionIndex:  uint(i),
+			EffectiveGasPrice: big.NewInt(3_000_000_000),
+			Logs:              ftx.logs,
+		}
+		if ftx.failed {
+			receipt.Status = types.ReceiptStatusFailed
+		}
+		if ftx.to == nil {
+			receipt.ContractAddress = crypto.CreateAddress(crypto.PubkeyToAddress(ftx.key.PublicKey), ftx.nonce)
+		}
+		for _, l := range ftx.logs {
+			l.TxHash = tx.Hash()
+			l.TxIndex = uint(i)
+			l.BlockNumber = number
+			l.Index = logIndex
+			logIndex++
+		}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		receipts = append(receipts, receipt)
+	}
+
+	block := types.NewBlock(header, signed, nil, receipts, trie.NewStackTrie(nil))
+	for _, r := range receipts {
+		r.BlockHash = block.Hash()
+		r.BlockNumber = block.Number()
+		for _, l := range r.Logs {
+			l.BlockHash = block.Hash()
+		}
+	}
+	b.blocks = append(b.blocks, block)
+	b.receipts[block.Hash()] = receipts
+	return block
+}
+
+// setCall makes calls of the contract method return the values.
+func (b *fakeBackend) setCall(to common.Address, contractABI *abi.ABI, method string, values ...any) {
+	m := contractABI.Methods[method]
+	out, err := m.Outputs.Pack(values...)
+	if err != nil {
+		panic(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var key fakeCallKey
+	key.to = to
+	copy(key.selector[:], m.ID)
+	b.calls[key] = out
+}
+
+func (b *fakeBackend) enter(method string, number *big.Int) error {
+	b.mu.Lock()
+	b.calledMethods[method]++
+	fail := b.fail
+	b.mu.Unlock()
+
+	if fail != nil {
+		return fail(method, number)
+	}
+	return nil
+}
+
+func (b *fakeBackend) block(number *big.Int) (*types.Block, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if number == nil {
+		return b.blocks[len(b.blocks)-1], nil
+	}
+	if !number.IsUint64() || number.Uint64() >= uint64(len(b.blocks)) {
+		return nil, ethereum.NotFound
+	}
+	return b.blocks[number.Uint64()], nil
+}
+
+func (b *fakeBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if err := b.enter("CodeAt", blockNumber); err != nil {
+		return nil, err
+	}
+	return []byte{0x1}, nil
+}
+
+func (b *fakeBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if err := b.enter("CallContract", blockNumber); err != nil {
+		return nil, err
+	}
+	if call.To == nil || len(call.Data) < 4 {
+		return nil, errors.New("execution reverted")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var key fakeCallKey
+	key.to = *call.To
+	copy(key.selector[:], call.Data[:4])
+	out, ok := b.calls[key]
+	if !ok {
+		return nil, errors.New("execution reverted")
+	}
+	return out, nil
+}
+
+func (b *fakeBackend) BlockNumber(ctx context.Context) (uint64, error) {
+	if err := b.enter("BlockNumber", nil); err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return uint64(len(b.blocks) - 1), nil
+}
+
+func (b *fakeBackend) ChainID(ctx context.Context) (*big.Int, error) {
+	if err := b.enter("ChainID", nil); err != nil {
+		return nil, err
+	}
+	return b.chainID, nil
+}
+
+func (b *fakeBackend) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if err := b.enter("BlockByNumber", number); err != nil {
+		return nil, err
+	}
+	if b.hold != nil {
+		select {
+		case <-b.hold:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return b.block(number)
+}
+
+func (b *fakeBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if err := b.enter("HeaderByNumber", number); err != nil {
+		return nil, err
+	}
+	block, err := b.block(number)
+	if err != nil {
+		return nil, err
+	}
+	return block.Header(), nil
+}
+
+func (b *fakeBackend) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	if err := b.enter("BalanceAt", blockNumber); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if balance, ok := b.balances[account]; ok {
+		return balance, nil
+	}
+	return new(big.Int), nil
+}
+
+func (b *fakeBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	if err := b.enter("FilterLogs", q.FromBlock); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []types.Log
+	for _, block := range b.blocks {
+		n := block.Number()
+		if q.FromBlock != nil && n.Cmp(q.FromBlock) < 0 || q.ToBlock != nil && n.Cmp(q.ToBlock) > 0 {
+			continue
+		}
+		for _, r := range b.receipts[block.Hash()] {
+			for _, l := range r.Logs {
+				if matchLog(l, q) {
+					result = append(result, *l)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func matchLog(l *types.Log, q ethereum.FilterQuery) bool {
+	if len(q.Addresses) > 0 {
+		found := false
+		for _, a := range q.Addresses {
+			found = found || a == l.Address
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for i, topics := range q.Topics {
+		if len(topics) == 0 {
+			continue
+		}
+		if i >= len(l.Topics) {
+			return false
+		}
+		found := false
+		for _, t := range topics {
+			found = found || t == l.Topics[i]
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *fakeBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if err := b.enter("TransactionReceipt", nil); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, block := range b.blocks {
+		for _, r := range b.receipts[block.Hash()] {
+			if r.TxHash == txHash {
+				return r, nil
+			}
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+func (b *fakeBackend) BlockReceipts(ctx context.Context, number *big.Int) ([]*types.Receipt, error) {
+	if err := b.enter("BlockReceipts", number); err != nil {
+		return nil, err
+	}
+	block, err := b.block(number)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	receipts := b.receipts[block.Hash()]
+	if b.blockReceipts != nil {
+		receipts = b.blockReceipts(append([]*types.Receipt(nil), receipts...))
+	}
+	return receipts, nil
+}
+
+func (b *fakeBackend) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	return nil, errors.New("notifications not supported")
+}
+
+// newTestService returns a collector on top of the backend without a running output.
+func newTestService(backend Backend) *collectorService {
+	c := &collectorService{
+		pool:         newEndpointPool(&endpoint{name: "fake", cli: backend, weight: 1}),
+		hashes:       newBlockHashes(),
+		limiter:      newRateLimiter(RateLimitConfig{}),
+		retry:        RetryConfig{MaxAttempts: 1},
+		logsBatch:    defaultLogsBatchSize,
+		maxLogsBatch: defaultMaxLogsBatchSize,
+		workers:      defaultWorkers,
+		quit:         make(chan struct{}),
+	}
+	c.retry.setDefaults()
+	return c
+}
+
+func mustKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
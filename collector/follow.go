@@ -0,0 +1,113 @@
+package collector
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultPollInterval = 12 * time.Second
+
+// follow collects blocks appearing after the historical range until the program is stopped.
+func (c *collectorService) follow(collect func() error, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	heads := make(chan uint64, 1)
+	go c.watchHeads(heads, pollInterval)
+
+	log.WithField("block", c.toBlock).Info("follow new blocks")
+
+	for {
+		select {
+		case <-c.quit:
+			return nil
+		case head := <-heads:
+			toBlock := c.confirmed(head)
+			if toBlock <= c.toBlock.Uint64() {
+				continue
+			}
+
+			c.fromBlock = new(big.Int).Add(c.toBlock, common.Big1)
+			c.toBlock = new(big.Int).SetUint64(toBlock)
+
+			if err := collect(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchHeads sends the number of the latest block to heads. It uses a new head
+// subscription if the endpoint supports it and polls the endpoint otherwise.
+func (c *collectorService) watchHeads(heads chan uint64, pollInterval time.Duration) {
+	if err := c.subscribeHeads(heads); err != nil {
+		log.WithError(err).Warn("subscribe new heads, fall back to polling")
+	} else {
+		return
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+
+		var head uint64
+		err := c.call("get last block", func(ctx context.Context, e *endpoint) (err error) {
+			head, err = e.cli.BlockNumber(ctx)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).Error("get last block")
+			continue
+		}
+		sendLatest(heads, head)
+	}
+}
+
+// subscribeHeads returns nil only after the program is stopped.
+func (c *collectorService) subscribeHeads(heads chan uint64) error {
+	headers := make(chan *types.Header)
+	sub, err := c.pool.subscribeNewHead(context.Background(), headers)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case <-c.quit:
+			return nil
+		case err := <-sub.Err():
+			return err
+		case header := <-headers:
+			sendLatest(heads, header.Number.Uint64())
+		}
+	}
+}
+
+// sendLatest replaces a head that is not received yet with the newer one.
+func sendLatest(heads chan uint64, head uint64) {
+	for {
+		select {
+		case heads <- head:
+			return
+		default:
+		}
+
+		select {
+		case <-heads:
+		default:
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TraceMethodDebug traces every block with debug_traceBlockByNumber and the call tracer.
+	TraceMethodDebug = "debug"
+	// TraceMethodFilter queries Parity-style trace_filter by the watched addresses.
+	TraceMethodFilter = "trace_filter"
+
+	transferKindInternal = "internal"
+)
+
+var errTracingNotSupported = errors.New("backend does not support tracing")
+
+// tracer is implemented by backends able to trace txs.
+type tracer interface {
+	TraceBlockByNumber(ctx context.Context, number *big.Int) ([]json.RawMessage, error)
+	TraceFilter(ctx context.Context, args TraceFilterArgs) ([]ParityTrace, error)
+	TraceTransaction(ctx context.Context, hash common.Hash) ([]ParityTrace, error)
+}
+
+// callFrame is a call of the geth call tracer.
+type callFrame struct {
+	Type  string         `json:"type"`
+	From  common.Address `json:"from"`
+	To    common.Address `json:"to"`
+	Value *hexutil.Big   `json:"value"`
+	Error string         `json:"error"`
+	Calls []callFrame    `json:"calls"`
+}
+
+type TraceFilterArgs struct {
+	FromBlock   hexutil.Uint64   `json:"fromBlock"`
+	ToBlock     hexutil.Uint64   `json:"toBlock"`
+	FromAddress []common.Address `json:"fromAddress,omitempty"`
+	ToAddress   []common.Address `json:"toAddress,omitempty"`
+	// After is the number of traces to skip and Count the max number of traces returned.
+	After uint64 `json:"after"`
+	Count uint64 `json:"count,omitempty"`
+}
+
+// traceFilterPageSize is the number of traces requested at once, nodes cap the
+// number of traces of a single response.
+const traceFilterPageSize = 1000
+
+// ParityTrace is an item of the trace_filter response.
+type ParityTrace struct {
+	Action struct {
+		CallType      string         `json:"callType"`
+		From          common.Address `json:"from"`
+		To            common.Address `json:"to"`
+		Value         *hexutil.Big   `json:"value"`
+		Address       common.Address `json:"address"`
+		RefundAddress common.Address `json:"refundAddress"`
+		Balance       *hexutil.Big   `json:"balance"`
+	} `json:"action"`
+	Result *struct {
+		Address common.Address `json:"address"`
+	} `json:"result"`
+	BlockNumber         uint64      `json:"blockNumber"`
+	TransactionHash     common.Hash `json:"transactionHash"`
+	TransactionPosition uint        `json:"transactionPosition"`
+	TraceAddress        []uint      `json:"traceAddress"`
+	Type                string      `json:"type"`
+	Error               string      `json:"error"`
+}
+
+// InternalTransfer is ETH moved by a call inside a tx.
+type InternalTransfer struct {
+	TxHash      common.Hash
+	BlockNumber uint64
+	TxIndex     uint
+	From        common.Address
+	To          common.Address
+	Value       *big.Int
+	// TracePath is the position of the call in the call tree like "0.2.1".
+	TracePath string
+}
+
+func (c *collectorService) internalTransfers(from, to uint64) ([]*InternalTransfer, error) {
+	if c.traceMethod == TraceMethodFilter {
+		return c.filterInternalTransfers(from, to)
+	}
+	return c.traceInternalTransfers(from, to)
+}
+
+// traceInternalTransfers traces every block of the range. It returns nothing if
+// the program is stopped, so the range is never sent partially.
+func (c *collectorService) traceInternalTransfers(from, to uint64) ([]*InternalTransfer, error) {
+	var result []*InternalTransfer
+	for num := from; num <= to; num++ {
+		if c.stopped() {
+			return nil, nil
+		}
+
+		blockNum := new(big.Int).SetUint64(num)
+		block, err := c.blockByNumber(context.Background(), blockNum)
+		if err != nil {
+			return nil, fmt.Errorf("get block %d: %w", num, err)
+		}
+		if len(block.Transactions()) == 0 {
+			continue
+		}
+
+		var traces []json.RawMessage
+		err = c.call(fmt.Sprintf("trace block %d", num), func(ctx context.Context, e *endpoint) (err error) {
+			t, ok := e.cli.(tracer)
+			if !ok {
+				return errTracingNotSupported
+			}
+			traces, err = t.TraceBlockByNumber(ctx, blockNum)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("trace block %d: %w", num, err)
+		}
+
+		txs := block.Transactions()
+		if len(traces) != len(txs) {
+			return nil, fmt.Errorf("block %d has %d txs but %d traces", num, len(txs), len(traces))
+		}
+
+		for i, raw := range traces {
+			var trace struct {
+				Result callFrame `json:"result"`
+				Error  string    `json:"error"`
+			}
+			if err := json.Unmarshal(raw, &trace); err != nil {
+				return nil, fmt.Errorf("unmarshal trace of tx %s: %w", txs[i].Hash().Hex(), err)
+			}
+			if trace.Error != "" {
+				log.WithField("tx_hash", txs[i].Hash().Hex()).
+					WithField("error", trace.Error).
+					Error("trace tx")
+				continue
+			}
+
+			// the top-level call is the tx itself, it is not an internal transfer
+			if trace.Result.Error != "" {
+				continue
+			}
+			for j, call := range trace.Result.Calls {
+				result = c.appendInternalCalls(result, call, []uint{uint(j)}, &InternalTransfer{
+					TxHash:      txs[i].Hash(),
+					BlockNumber: num,
+					TxIndex:     uint(i),
+				})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// appendInternalCalls appends value-bearing calls of the subtree touching watched
+// addresses. Reverted calls move nothing, so their subtrees are skipped.
+func (c *collectorService) appendInternalCalls(
+	result []*InternalTransfer, call callFrame, path []uint, tx *InternalTransfer,
+) []*InternalTransfer {
+	if call.Error != "" {
+		return result
+	}
+
+	callType := strings.ToUpper(call.Type)
+	if call.Value != nil && call.Value.ToInt().Sign() > 0 &&
+		callType != "DELEGATECALL" && callType != "STATICCALL" &&
+		(c.isWatched(call.From) || c.isWatched(call.To)) {
+		t := *tx
+		t.From = call.From
+		t.To = call.To
+		t.Value = call.Value.ToInt()
+		t.TracePath = tracePath(path)
+		result = append(result, &t)
+	}
+
+	for i, sub := range call.Calls {
+		result = c.appendInternalCalls(result, sub, append(path[:len(path):len(path)], uint(i)), tx)
+	}
+	return result
+}
+
+// filterInternalTransfers queries traces from and to the watched addresses page by page.
+// A call may succeed while its parent or the whole tx reverts, so the matched calls
+// under a reverted call of their tx are dropped.
+func (c *collectorService) filterInternalTransfers(from, to uint64) ([]*InternalTransfer, error) {
+	var (
+		result []*InternalTransfer
+		paths  = make(map[*InternalTransfer][]uint)
+		seen   = make(map[string]struct{})
+	)
+	for _, args := range []TraceFilterArgs{
+		{FromBlock: hexutil.Uint64(from), ToBlock: hexutil.Uint64(to), FromAddress: c.addresses},
+		{FromBlock: hexutil.Uint64(from), ToBlock: hexutil.Uint64(to), ToAddress: c.addresses},
+	} {
+		args.Count = traceFilterPageSize
+		for {
+			if c.stopped() {
+				return nil, nil
+			}
+
+			var traces []ParityTrace
+			err := c.call(fmt.Sprintf("filter traces from %d to %d after %d", from, to, args.After), func(ctx context.Context, e *endpoint) (err error) {
+				t, ok := e.cli.(tracer)
+				if !ok {
+					return errTracingNotSupported
+				}
+				traces, err = t.TraceFilter(ctx, args)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("filter traces from %d to %d: %w", from, to, err)
+			}
+
+			for _, trace := range traces {
+				t, ok := c.traceTransfer(trace)
+				if !ok {
+					continue
+				}
+
+				key := t.TxHash.Hex() + t.TracePath
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+
+				paths[t] = trace.TraceAddress
+				result = append(result, t)
+			}
+
+			if len(traces) < traceFilterPageSize {
+				break
+			}
+			args.After += uint64(len(traces))
+		}
+	}
+
+	reverted := make(map[common.Hash][][]uint)
+	kept := result[:0]
+	for _, t := range result {
+		failed, ok := reverted[t.TxHash]
+		if !ok {
+			var err error
+			if failed, err = c.revertedCalls(t.TxHash); err != nil {
+				return nil, err
+			}
+			reverted[t.TxHash] = failed
+		}
+		if !underReverted(paths[t], failed) {
+			kept = append(kept, t)
+		}
+	}
+
+	return kept, nil
+}
+
+// revertedCalls returns the trace addresses of the calls of the tx that failed,
+// an empty one if the whole tx reverted.
+func (c *collectorService) revertedCalls(hash common.Hash) ([][]uint, error) {
+	var traces []ParityTrace
+	err := c.call("trace tx "+hash.Hex(), func(ctx context.Context, e *endpoint) (err error) {
+		t, ok := e.cli.(tracer)
+		if !ok {
+			return errTracingNotSupported
+		}
+		traces, err = t.TraceTransaction(ctx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("trace tx %s: %w", hash.Hex(), err)
+	}
+
+	var reverted [][]uint
+	for _, trace := range traces {
+		if trace.Error != "" {
+			reverted = append(reverted, trace.TraceAddress)
+		}
+	}
+	return reverted, nil
+}
+
+// underReverted reports whether the call at the path is one of the reverted calls
+// or inside one of them.
+func underReverted(path []uint, reverted [][]uint) bool {
+	for _, prefix := range reverted {
+		if len(prefix) > len(path) {
+			continue
+		}
+		under := true
+		for i := range prefix {
+			under = under && path[i] == prefix[i]
+		}
+		if under {
+			return true
+		}
+	}
+	return false
+}
+
+// traceTransfer returns the internal transfer of the trace if it moves ETH of a watched address.
+func (c *collectorService) traceTransfer(trace ParityTrace) (*InternalTransfer, bool) {
+	// the top-level call is the tx itself, it is not an internal transfer
+	if len(trace.TraceAddress) == 0 || trace.Error != "" {
+		return nil, false
+	}
+
+	t := InternalTransfer{
+		TxHash:      trace.TransactionHash,
+		BlockNumber: trace.BlockNumber,
+		TxIndex:     trace.TransactionPosition,
+		TracePath:   tracePath(trace.TraceAddress),
+	}
+	switch trace.Type {
+	case "call":
+		if trace.Action.CallType == "delegatecall" || trace.Action.CallType == "staticcall" {
+			return nil, false
+		}
+		t.From, t.To, t.Value = trace.Action.From, trace.Action.To, trace.Action.Value.ToInt()
+	case "create":
+		if trace.Result == nil {
+			return nil, false
+		}
+		t.From, t.To, t.Value = trace.Action.From, trace.Result.Address, trace.Action.Value.ToInt()
+	case "suicide":
+		t.From, t.To, t.Value = trace.Action.Address, trace.Action.RefundAddress, trace.Action.Balance.ToInt()
+	default:
+		return nil, false
+	}
+
+	if t.Value == nil || t.Value.Sign() == 0 || (!c.isWatched(t.From) && !c.isWatched(t.To)) {
+		return nil, false
+	}
+	return &t, true
+}
+
+func (c *collectorService) convertInternalTransfer(t *InternalTransfer) (TransferInfo, bool) {
+	return TransferInfo{
+		Token:           nativeToken.Address,
+		Symbol:          nativeToken.Symbol,
+		From:            t.From.Hex(),
+		To:              t.To.Hex(),
+		Value:           t.Value.String(),
+		NormalizedValue: Normalize(t.Value, nativeToken.Decimals),
+		TxHash:          t.TxHash.Hex(),
+		BlockNumber:     t.BlockNumber,
+		Watched:         c.matchedAddresses(t.From, t.To),
+		Kind:            transferKindInternal,
+		TracePath:       t.TracePath,
+	}, true
+}
+
+func tracePath(path []uint) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = strconv.FormatUint(uint64(p), 10)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// fakeTracer serves trace_filter from a list of traces.
+type fakeTracer struct {
+	*fakeBackend
+	traces []ParityTrace
+	pages  []TraceFilterArgs
+}
+
+func (f *fakeTracer) TraceBlockByNumber(ctx context.Context, number *big.Int) ([]json.RawMessage, error) {
+	return nil, errTracingNotSupported
+}
+
+func (f *fakeTracer) TraceFilter(ctx context.Context, args TraceFilterArgs) ([]ParityTrace, error) {
+	f.pages = append(f.pages, args)
+
+	var matched []ParityTrace
+	for _, t := range f.traces {
+		if len(args.FromAddress) > 0 && t.Action.From == args.FromAddress[0] ||
+			len(args.ToAddress) > 0 && t.Action.To == args.ToAddress[0] {
+			matched = append(matched, t)
+		}
+	}
+
+	if args.After >= uint64(len(matched)) {
+		return nil, nil
+	}
+	matched = matched[args.After:]
+	if args.Count > 0 && uint64(len(matched)) > args.Count {
+		matched = matched[:args.Count]
+	}
+	return matched, nil
+}
+
+func (f *fakeTracer) TraceTransaction(ctx context.Context, hash common.Hash) ([]ParityTrace, error) {
+	var traces []ParityTrace
+	for _, t := range f.traces {
+		if t.TransactionHash == hash {
+			traces = append(traces, t)
+		}
+	}
+	return traces, nil
+}
+
+func callTrace(tx int64, from, to common.Address, value int64, errMsg string, path ...uint) ParityTrace {
+	var trace ParityTrace
+	trace.Type = "call"
+	trace.Action.CallType = "call"
+	trace.Action.From, trace.Action.To = from, to
+	trace.Action.Value = (*hexutil.Big)(big.NewInt(value))
+	trace.TransactionHash = common.BigToHash(big.NewInt(tx))
+	trace.TransactionPosition = uint(tx)
+	trace.TraceAddress = path
+	trace.Error = errMsg
+	return trace
+}
+
+func TestFilterInternalTransfersReverted(t *testing.T) {
+	var (
+		watched   = common.HexToAddress("0xa")
+		other     = common.HexToAddress("0xb")
+		contract  = common.HexToAddress("0xc")
+		contract2 = common.HexToAddress("0xd")
+	)
+
+	f := &fakeTracer{fakeBackend: newFakeBackend(t, 1)}
+	f.traces = []ParityTrace{
+		// tx 1: the call to the contract reverts after it paid the watched address
+		callTrace(1, other, contract, 0, ""),
+		callTrace(1, contract, contract2, 0, "Reverted", 0),
+		callTrace(1, contract2, watched, 10, "", 0, 0),
+		callTrace(1, contract, watched, 20, "", 1),
+		// tx 2: the whole tx reverts
+		callTrace(2, other, contract, 0, "Reverted"),
+		callTrace(2, contract, watched, 30, "", 0),
+		// tx 3: a reverted sibling doesn't affect the other calls
+		callTrace(3, other, contract, 0, ""),
+		callTrace(3, contract, watched, 40, "", 0),
+		callTrace(3, contract, other, 0, "Reverted", 1),
+		callTrace(3, contract, watched, 50, "", 10),
+	}
+
+	c := newTestService(f)
+	c.initAddresses(Config{Address: watched.Hex()})
+	c.traceMethod = TraceMethodFilter
+
+	transfers, err := c.internalTransfers(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, tr := range transfers {
+		got = append(got, tr.Value.String()+"@"+tr.TracePath)
+	}
+	if want := []string{"20@1", "40@0", "50@10"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("transfers = %v, want %v", got, want)
+	}
+}
+
+func TestSortTransfersByTracePath(t *testing.T) {
+	internal := func(tx uint, path string) *InternalTransfer {
+		return &InternalTransfer{BlockNumber: 1, TxIndex: tx, TracePath: path}
+	}
+	// traces of the from and to queries are concatenated
+	internals := []*InternalTransfer{
+		internal(0, "2"), internal(0, "0.10"), internal(1, "0"),
+		internal(0, "0.2"), internal(0, "0"), internal(0, "10"),
+	}
+
+	var got []string
+	for _, tr := range sortTransfers(nil, nil, internals) {
+		it := tr.(*InternalTransfer)
+		got = append(got, strconv.Itoa(int(it.TxIndex))+":"+it.TracePath)
+	}
+	if want := "0:0,0:0.2,0:0.10,0:2,0:10,1:0"; strings.Join(got, ",") != want {
+		t.Errorf("order = %v, want %s", got, want)
+	}
+}
+
+func TestFilterInternalTransfersPages(t *testing.T) {
+	watched, other := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+
+	f := &fakeTracer{fakeBackend: newFakeBackend(t, 1)}
+	for i := 0; i < 2500; i++ {
+		var trace ParityTrace
+		trace.Type = "call"
+		trace.Action.CallType = "call"
+		trace.Action.From, trace.Action.To = watched, other
+		if i%2 == 1 {
+			trace.Action.From, trace.Action.To = other, watched
+		}
+		trace.Action.Value = (*hexutil.Big)(big.NewInt(int64(i + 1)))
+		trace.TransactionHash = common.BigToHash(big.NewInt(int64(i)))
+		trace.TraceAddress = []uint{0}
+		f.traces = append(f.traces, trace)
+	}
+
+	c := newTestService(f)
+	c.initAddresses(Config{Address: watched.Hex()})
+	c.traceMethod = TraceMethodFilter
+
+	transfers, err := c.internalTransfers(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != len(f.traces) {
+		t.Errorf("got %d transfers, want %d", len(transfers), len(f.traces))
+	}
+
+	// 1250 traces in each direction take two pages
+	if len(f.pages) != 4 {
+		t.Fatalf("%d trace_filter calls, want 4", len(f.pages))
+	}
+	for i, want := range []uint64{0, 1000, 0, 1000} {
+		if f.pages[i].After != want || f.pages[i].Count != traceFilterPageSize {
+			t.Errorf("page %d after %d count %d, want after %d", i, f.pages[i].After, f.pages[i].Count, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// jsonlSink writes a JSON object per line. Keys are the csv column names in the
+// column order, so both formats describe rows the same way.
+type jsonlSink struct {
+	*outputFile
+}
+
+func newJSONLSink(file *outputFile) *jsonlSink {
+	return &jsonlSink{outputFile: file}
+}
+
+func (s *jsonlSink) write(row any) error {
+	data, err := marshalJSONRow(row)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	_, err = s.writer.Write(data)
+	return err
+}
+
+// rowField is a field of a row struct and its column name.
+type rowField struct {
+	index int
+	name  string
+}
+
+var rowFieldsCache sync.Map // reflect.Type -> []rowField
+
+func rowFields(t reflect.Type) []rowField {
+	if fields, ok := rowFieldsCache.Load(t); ok {
+		return fields.([]rowField)
+	}
+
+	var fields []rowField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("csv"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, rowField{index: i, name: name})
+	}
+
+	rowFieldsCache.Store(t, fields)
+	return fields
+}
+
+func marshalJSONRow(row any) ([]byte, error) {
+	v := reflect.ValueOf(row)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("row of type %s is not a struct", v.Type())
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range rowFields(v.Type()) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v.Field(f.index).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s: %w", f.name, err)
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// readJSONLRows decodes lines into out, a pointer to a slice of row structs.
+func readJSONLRows(r io.Reader, out any) error {
+	slice := reflect.ValueOf(out).Elem()
+	rowType := slice.Type().Elem()
+	fields := rowFields(rowType)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &values); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		row := reflect.New(rowType).Elem()
+		for _, f := range fields {
+			value, ok := values[f.name]
+			if !ok {
+				continue
+			}
+			if err := json.Unmarshal(value, row.Field(f.index).Addr().Interface()); err != nil {
+				return fmt.Errorf("line %d: %s: %w", line, f.name, err)
+			}
+		}
+		slice.Set(reflect.Append(slice, row))
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,227 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogsBatchSize    = 1000
+	defaultMaxLogsBatchSize = 100000
+	// logsGrowThreshold is the number of logs in a range below which the next range is doubled.
+	logsGrowThreshold = 1000
+	// addressBatchSize is the max number of addresses in a single logs query.
+	addressBatchSize = 100
+)
+
+// logsQuery is a contract and topic filter of a logs query.
+type logsQuery struct {
+	addresses []common.Address
+	topics    [][]common.Hash
+	// senderTopic is the index of the topic holding the sender in queries by receivers.
+	// Logs sent by watched addresses are skipped there, they are returned by queries by senders.
+	senderTopic int
+}
+
+// collectRanges walks the block range in chunks sized for logs queries, checks the
+// chain for reorganizations and makes a checkpoint after each chunk. fetch returns
+// the messages of a chunk in the chain order and the number of logs it queried.
+func (c *collectorService) collectRanges(fetch func(q ethereum.FilterQuery) ([]any, int, error)) error {
+	q := ethereum.FilterQuery{ToBlock: new(big.Int).Sub(c.fromBlock, common.Big1)}
+	updateQuery(&q, c.logsBatch, c.toBlock)
+
+	for q.FromBlock.Cmp(c.toBlock) <= 0 {
+		trackReorgs := c.nearHead(q.ToBlock)
+		if trackReorgs {
+			header, err := c.headerByNumber(q.FromBlock)
+			if err != nil {
+				return fmt.Errorf("get header %d: %w", q.FromBlock, err)
+			}
+
+			next, reorg, err := c.checkReorg(header)
+			if err != nil {
+				return fmt.Errorf("check reorg at block %d: %w", q.FromBlock, err)
+			}
+			if reorg {
+				q.ToBlock = new(big.Int).SetUint64(next - 1)
+				updateQuery(&q, c.logsBatch, c.toBlock)
+				continue
+			}
+		}
+
+		span := q.ToBlock.Uint64() - q.FromBlock.Uint64() + 1
+		msgs, logs, err := fetch(q)
+		if err != nil {
+			if isRangeTooLarge(err) && c.shrinkLogsBatch(span) {
+				q.ToBlock = new(big.Int).Sub(q.FromBlock, common.Big1)
+				updateQuery(&q, c.logsBatch, c.toBlock)
+				continue
+			}
+			return fmt.Errorf("collect from %d to %d: %w", q.FromBlock, q.ToBlock, err)
+		}
+
+		if c.stopped() {
+			return nil
+		}
+
+		for _, msg := range msgs {
+			c.msgChan <- msg
+		}
+
+		if trackReorgs {
+			if err := c.recordHashes(q.FromBlock, q.ToBlock); err != nil {
+				return err
+			}
+		}
+		c.msgChan <- checkpointMsg(q.ToBlock.Uint64())
+
+		c.growLogsBatch(span, logs)
+		updateQuery(&q, c.logsBatch, c.toBlock)
+	}
+
+	return nil
+}
+
+// filterLogs returns logs of the range for all queries. It returns nothing if the
+// program is stopped, so the range is never sent partially.
+func (c *collectorService) filterLogs(q ethereum.FilterQuery, queries []logsQuery) ([]types.Log, error) {
+	var (
+		result []types.Log
+		served = make(map[string]struct{})
+	)
+	for _, lq := range queries {
+		if c.stopped() {
+			return nil, nil
+		}
+
+		q.Addresses = lq.addresses
+		q.Topics = lq.topics
+		var events []types.Log
+		err := c.call(fmt.Sprintf("filter logs from %d to %d", q.FromBlock, q.ToBlock), func(ctx context.Context, e *endpoint) (err error) {
+			events, err = e.cli.FilterLogs(ctx, q)
+			if err == nil {
+				served[e.name] = struct{}{}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range events {
+			if c.nearHead(q.ToBlock) {
+				// a log of a block reorganized since is detected by its hash
+				c.hashes.add(event.BlockNumber, event.BlockHash)
+			}
+			if lq.senderTopic > 0 && len(event.Topics) > lq.senderTopic &&
+				c.isWatched(common.BytesToAddress(event.Topics[lq.senderTopic].Bytes())) {
+				// the log sent between watched addresses is already returned by the sender
+				continue
+			}
+			result = append(result, event)
+		}
+	}
+
+	endpoints := make([]string, 0, len(served))
+	for name := range served {
+		endpoints = append(endpoints, name)
+	}
+	log.WithField("from_block", q.FromBlock).
+		WithField("to_block", q.ToBlock).
+		WithField("endpoints", endpoints).
+		WithField("logs", len(result)).
+		Info("logs range collected")
+
+	return result, nil
+}
+
+// sortLogs puts logs of several queries in the chain order.
+func sortLogs(events []types.Log) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].BlockNumber != events[j].BlockNumber {
+			return events[i].BlockNumber < events[j].BlockNumber
+		}
+		return events[i].Index < events[j].Index
+	})
+}
+
+// addressBatches splits the watched addresses into topic lists for logs queries.
+func (c *collectorService) addressBatches() [][]common.Hash {
+	var batches [][]common.Hash
+	for i, address := range c.addresses {
+		if i%addressBatchSize == 0 {
+			batches = append(batches, nil)
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], address.Hash())
+	}
+	return batches
+}
+
+func updateQuery(q *ethereum.FilterQuery, batchSize uint64, maxBlock *big.Int) {
+	q.FromBlock = new(big.Int).Add(q.ToBlock, common.Big1)
+	// ranges are inclusive
+	q.ToBlock = minBigInt(new(big.Int).Add(q.ToBlock, new(big.Int).SetUint64(batchSize)), maxBlock)
+}
+
+func minBigInt(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return a
+	}
+	return b
+}
+
+// rangeTooLargeErrors are the messages of providers rejecting a logs query because of its size.
+var rangeTooLargeErrors = []string{
+	"query returned more than",
+	"log response size exceeded",
+	"block range too large",
+	"block range is too wide",
+	"exceed maximum block range",
+	"exceeds maximum rpc range limit",
+	"requested too many blocks",
+	"eth_getlogs is limited to",
+	"query timeout exceeded",
+}
+
+// isRangeTooLarge reports whether the node rejected a logs query because of its size.
+func isRangeTooLarge(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range rangeTooLargeErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// shrinkLogsBatch halves the logs range. It returns false if the range is a single block.
+func (c *collectorService) shrinkLogsBatch(span uint64) bool {
+	if span <= 1 {
+		return false
+	}
+
+	c.logsBatch = span / 2
+	log.WithField("batch_size", c.logsBatch).Info("logs range too large, shrink")
+	return true
+}
+
+// growLogsBatch doubles the logs range if the last full-size range had few logs.
+func (c *collectorService) growLogsBatch(span uint64, logs int) {
+	if span < c.logsBatch || logs >= logsGrowThreshold || c.logsBatch >= c.maxLogsBatch {
+		return
+	}
+
+	c.logsBatch *= 2
+	if c.logsBatch > c.maxLogsBatch {
+		c.logsBatch = c.maxLogsBatch
+	}
+	log.WithField("batch_size", c.logsBatch).Debug("logs range is sparse, grow")
+}
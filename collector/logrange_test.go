@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestRangeTooLargeErrors(t *testing.T) {
+	tests := []struct {
+		msg       string
+		tooLarge  bool
+		retryable bool
+	}{
+		{msg: "query returned more than 10000 results", tooLarge: true},
+		{msg: "Log response size exceeded. You can make eth_getLogs requests with up to a 2K block range", tooLarge: true},
+		{msg: "query timeout exceeded", tooLarge: true},
+		{msg: "exceed maximum block range: 5000", tooLarge: true},
+		{msg: "eth_getLogs is limited to a 10000 range", tooLarge: true},
+		{msg: "rate limit exceeded", retryable: true},
+		{msg: "daily request count limit exceeded"},
+		{msg: "429 Too Many Requests", retryable: true},
+		{msg: "i/o timeout", retryable: true},
+		{msg: "execution reverted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			err := fmt.Errorf("filter logs: %w", errors.New(tt.msg))
+			if got := isRangeTooLarge(err); got != tt.tooLarge {
+				t.Errorf("isRangeTooLarge() = %t, want %t", got, tt.tooLarge)
+			}
+			if got := isRetryable(err); got != tt.retryable {
+				t.Errorf("isRetryable() = %t, want %t", got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestCollectRangesBisect(t *testing.T) {
+	const limit = 100
+
+	b := newFakeBackend(t, 1000)
+	c := newTestService(b)
+	c.fromBlock, c.toBlock = big.NewInt(0), big.NewInt(999)
+	c.logsBatch = 400
+
+	msgs := make(chan any)
+	c.msgChan = msgs
+	var checkpoints []uint64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range msgs {
+			if cp, ok := msg.(checkpointMsg); ok {
+				checkpoints = append(checkpoints, uint64(cp))
+			}
+		}
+	}()
+
+	var ranges [][2]uint64
+	err := c.collectRanges(func(q ethereum.FilterQuery) ([]any, int, error) {
+		if span := q.ToBlock.Uint64() - q.FromBlock.Uint64() + 1; span > limit {
+			return nil, 0, fmt.Errorf("query returned more than 10000 results")
+		}
+		ranges = append(ranges, [2]uint64{q.FromBlock.Uint64(), q.ToBlock.Uint64()})
+		return nil, 0, nil
+	})
+	close(msgs)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := uint64(0)
+	for _, r := range ranges {
+		if r[0] != next {
+			t.Fatalf("range %v doesn't start at %d", r, next)
+		}
+		next = r[1] + 1
+	}
+	if next != 1000 {
+		t.Errorf("collected up to %d, want 999", next-1)
+	}
+	if len(checkpoints) != len(ranges) || checkpoints[len(checkpoints)-1] != 999 {
+		t.Errorf("checkpoints %v don't match ranges %v", checkpoints, ranges)
+	}
+}
+
+func TestFilterLogsRangeTooLargeNotRetried(t *testing.T) {
+	b := newFakeBackend(t, 10)
+	b.fail = func(method string, number *big.Int) error {
+		return errors.New("query timeout exceeded")
+	}
+	c := newTestService(b)
+	c.retry.MaxAttempts = 5
+
+	q := ethereum.FilterQuery{FromBlock: big.NewInt(0), ToBlock: big.NewInt(9)}
+	if _, err := c.filterLogs(q, []logsQuery{{}}); !isRangeTooLarge(err) {
+		t.Fatalf("filterLogs() error = %v, want range too large", err)
+	}
+	if calls := b.calledMethods["FilterLogs"]; calls != 1 {
+		t.Errorf("%d attempts, want 1", calls)
+	}
+}
+
+func TestFilterLogsRecordsEventHashes(t *testing.T) {
+	key := mustKey(t)
+	token, watched, other := common.HexToAddress("0x70"), common.HexToAddress("0xa"), common.HexToAddress("0xb")
+
+	b := newFakeBackend(t, 0)
+	for i := 0; i < 50; i++ {
+		var txs []fakeTx
+		if i == 45 {
+			txs = []fakeTx{{key: key, to: &token, logs: []*types.Log{transferLog(t, token, watched, other, 1)}}}
+		}
+		b.addBlock(txs)
+	}
+
+	c := newTestService(b)
+	c.trackReorgs = true
+	c.toBlock = big.NewInt(49)
+
+	q := ethereum.FilterQuery{FromBlock: big.NewInt(40), ToBlock: big.NewInt(49)}
+	if _, err := c.filterLogs(q, []logsQuery{{}}); err != nil {
+		t.Fatal(err)
+	}
+	if hash, ok := c.hashes.get(45); !ok || hash != b.blocks[45].Hash() {
+		t.Errorf("hash of the log block = %s, %t", hash.Hex(), ok)
+	}
+
+	// the hash of the log block is kept, the other blocks of the range are recorded
+	c.hashes.add(45, common.Hash{1})
+	if err := c.recordHashes(q.FromBlock, q.ToBlock); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := c.hashes.get(45); hash != (common.Hash{1}) {
+		t.Error("hash of the log block is overwritten")
+	}
+	for num := uint64(40); num < 50; num++ {
+		if _, ok := c.hashes.get(num); !ok {
+			t.Errorf("hash of block %d isn't recorded", num)
+		}
+	}
+}
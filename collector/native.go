@@ -0,0 +1,156 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// nativeToken is the pseudo token of native ETH transfers.
+var nativeToken = tokenInfo{Address: "ETH", Symbol: "ETH", Decimals: 18}
+
+// NativeTransfer is a successful top-level tx moving ETH from or to a watched address.
+type NativeTransfer struct {
+	Tx          *types.Transaction
+	Sender      common.Address
+	BlockNumber uint64
+	TxIndex     uint
+}
+
+// nativeTransfers scans blocks from..to for native transfers. It returns nothing
+// if the program is stopped, so the range is never sent partially.
+func (c *collectorService) nativeTransfers(from, to uint64) ([]*NativeTransfer, error) {
+	blocks, stop := c.fetchBlocks(from, to)
+	defer stop()
+
+	var result []*NativeTransfer
+	for res := range blocks {
+		if c.stopped() {
+			return nil, nil
+		}
+		if res.err != nil {
+			return nil, fmt.Errorf("get block %d: %w", res.num, res.err)
+		}
+
+		var (
+			txs       []*types.Transaction
+			senders   []common.Address
+			positions []uint
+		)
+		for i, tx := range res.block.Transactions() {
+			if tx.Value().Sign() == 0 {
+				continue
+			}
+
+			sender := c.txSender(tx)
+			if c.isWatched(sender) || c.isWatched(txReceiver(tx, sender)) {
+				txs = append(txs, tx)
+				senders = append(senders, sender)
+				positions = append(positions, uint(i))
+			}
+		}
+
+		if len(txs) == 0 {
+			continue
+		}
+
+		// failed txs do not move ETH
+		receipts, err := c.receipts(res.block, txs)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, tx := range txs {
+			if r := receipts[tx.Hash()]; r == nil || r.Status != types.ReceiptStatusSuccessful {
+				continue
+			}
+
+			result = append(result, &NativeTransfer{
+				Tx:          tx,
+				Sender:      senders[i],
+				BlockNumber: res.num,
+				TxIndex:     positions[i],
+			})
+		}
+	}
+
+	return result, nil
+}
+
+func (c *collectorService) convertNativeTransfer(t *NativeTransfer) (TransferInfo, bool) {
+	receiver := txReceiver(t.Tx, t.Sender)
+
+	return TransferInfo{
+		Token:           nativeToken.Address,
+		Symbol:          nativeToken.Symbol,
+		From:            t.Sender.Hex(),
+		To:              receiver.Hex(),
+		Value:           t.Tx.Value().String(),
+		NormalizedValue: Normalize(t.Tx.Value(), nativeToken.Decimals),
+		TxHash:          t.Tx.Hash().Hex(),
+		BlockNumber:     t.BlockNumber,
+		Watched:         c.matchedAddresses(t.Sender, receiver),
+		Kind:            transferKindNative,
+	}, true
+}
+
+// sortTransfers orders token transfer logs, native and internal transfers by their
+// position in the chain. In a tx the native transfer goes first, then internal
+// transfers in the call order and then logs.
+func sortTransfers(events []types.Log, natives []*NativeTransfer, internals []*InternalTransfer) []any {
+	type item struct {
+		block, tx uint64
+		log       int
+		path      string
+		transfer  any
+	}
+
+	items := make([]item, 0, len(events)+len(natives)+len(internals))
+	for _, n := range natives {
+		items = append(items, item{n.BlockNumber, uint64(n.TxIndex), -2, "", n})
+	}
+	for _, t := range internals {
+		items = append(items, item{t.BlockNumber, uint64(t.TxIndex), -1, t.TracePath, t})
+	}
+	for _, e := range events {
+		items = append(items, item{e.BlockNumber, uint64(e.TxIndex), int(e.Index), "", e})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.block != b.block {
+			return a.block < b.block
+		}
+		if a.tx != b.tx {
+			return a.tx < b.tx
+		}
+		if a.log != b.log {
+			return a.log < b.log
+		}
+		return lessTracePath(a.path, b.path)
+	})
+
+	transfers := make([]any, len(items))
+	for i, it := range items {
+		transfers[i] = it.transfer
+	}
+	return transfers
+}
+
+// lessTracePath orders trace paths like "0.2.1" by the call order, a call goes
+// before the calls it makes.
+func lessTracePath(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.ParseUint(as[i], 10, 64)
+		y, _ := strconv.ParseUint(bs[i], 10, 64)
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,292 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"collector/smartcontract/erc1155"
+	"collector/smartcontract/erc721"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nftStandardERC721  = "ERC-721"
+	nftStandardERC1155 = "ERC-1155"
+)
+
+type nftABIs struct {
+	erc721  *abi.ABI
+	erc1155 *abi.ABI
+}
+
+func loadNFTABIs() (nftABIs, error) {
+	erc721ABI, err := erc721.Erc721MetaData.GetAbi()
+	if err != nil {
+		return nftABIs{}, fmt.Errorf("erc721: %w", err)
+	}
+	erc1155ABI, err := erc1155.Erc1155MetaData.GetAbi()
+	if err != nil {
+		return nftABIs{}, fmt.Errorf("erc1155: %w", err)
+	}
+	return nftABIs{erc721: erc721ABI, erc1155: erc1155ABI}, nil
+}
+
+// NFTTransfer is a single token moved by an ERC-721 or ERC-1155 transfer event.
+// An ERC-1155 batch transfer gives one NFTTransfer per token.
+type NFTTransfer struct {
+	Standard    string
+	Collection  common.Address
+	Operator    common.Address
+	From        common.Address
+	To          common.Address
+	TokenID     *big.Int
+	Amount      *big.Int
+	TxHash      common.Hash
+	BlockNumber uint64
+	EventID     uint
+	// BatchIndex is the position of the token in an ERC-1155 batch transfer.
+	BatchIndex int
+}
+
+type NFTTransferInfo struct {
+	Collection  string `csv:"collection"`
+	Name        string `csv:"name"`
+	Symbol      string `csv:"symbol"`
+	Standard    string `csv:"standard"`
+	Operator    string `csv:"operator"`
+	From        string `csv:"from"`
+	To          string `csv:"to"`
+	TokenID     string `csv:"token_id"`
+	Amount      string `csv:"amount"`
+	TxHash      string `csv:"tx_hash"`
+	BlockNumber uint64 `csv:"block_number"`
+	EventID     uint16 `csv:"event_id"`
+	BatchIndex  int    `csv:"batch_index"`
+	Watched     string `csv:"watched"`
+}
+
+func (c *collectorService) collectNFTTransfers() error {
+	log.WithField("from_block", c.fromBlock).
+		WithField("to_block", c.toBlock).
+		WithField("addresses", c.addresses).
+		Info("collect nft transfers")
+
+	var (
+		transferTopic = c.nftABIs.erc721.Events["Transfer"].ID
+		singleTopic   = c.nftABIs.erc1155.Events["TransferSingle"].ID
+		batchTopic    = c.nftABIs.erc1155.Events["TransferBatch"].ID
+		queries       []logsQuery
+	)
+	for _, batch := range c.addressBatches() {
+		queries = append(queries,
+			logsQuery{topics: [][]common.Hash{{transferTopic}, batch}},
+			logsQuery{topics: [][]common.Hash{{transferTopic}, {}, batch}, senderTopic: 1},
+			// ERC-1155 events start with the indexed operator
+			logsQuery{topics: [][]common.Hash{{singleTopic, batchTopic}, {}, batch}},
+			logsQuery{topics: [][]common.Hash{{singleTopic, batchTopic}, {}, {}, batch}, senderTopic: 2},
+		)
+	}
+
+	return c.collectRanges(func(q ethereum.FilterQuery) ([]any, int, error) {
+		events, err := c.filterLogs(q, queries)
+		if err != nil || c.stopped() {
+			return nil, 0, err
+		}
+
+		// logs of different queries are mixed, the output is in the chain order
+		sortLogs(events)
+
+		var result []any
+		for i := range events {
+			transfers, err := c.parseNFTTransfers(&events[i])
+			if err != nil {
+				log.WithError(err).
+					WithField("tx_hash", events[i].TxHash.Hex()).
+					WithField("event_id", events[i].Index).
+					Error("parse nft transfer event")
+				continue
+			}
+			for _, t := range transfers {
+				result = append(result, t)
+			}
+		}
+
+		return result, len(events), nil
+	})
+}
+
+// parseNFTTransfers recognizes the event by its signature and number of topics.
+// ERC-20 transfers share the signature with ERC-721 but their value is not indexed,
+// they are skipped.
+func (c *collectorService) parseNFTTransfers(event *types.Log) ([]*NFTTransfer, error) {
+	if len(event.Topics) == 0 {
+		return nil, nil
+	}
+
+	base := NFTTransfer{
+		Collection:  event.Address,
+		TxHash:      event.TxHash,
+		BlockNumber: event.BlockNumber,
+		EventID:     event.Index,
+	}
+
+	switch event.Topics[0] {
+	case c.nftABIs.erc721.Events["Transfer"].ID:
+		if len(event.Topics) != 4 {
+			return nil, nil
+		}
+
+		var transfer erc721.Erc721Transfer
+		if err := unpackEvent(c.nftABIs.erc721, "Transfer", &transfer, event); err != nil {
+			return nil, err
+		}
+
+		base.Standard = nftStandardERC721
+		base.From, base.To = transfer.From, transfer.To
+		base.TokenID, base.Amount = transfer.TokenId, common.Big1
+		return []*NFTTransfer{&base}, nil
+
+	case c.nftABIs.erc1155.Events["TransferSingle"].ID:
+		var transfer erc1155.Erc1155TransferSingle
+		if err := unpackEvent(c.nftABIs.erc1155, "TransferSingle", &transfer, event); err != nil {
+			return nil, err
+		}
+
+		base.Standard = nftStandardERC1155
+		base.Operator, base.From, base.To = transfer.Operator, transfer.From, transfer.To
+		base.TokenID, base.Amount = transfer.Id, transfer.Value
+		return []*NFTTransfer{&base}, nil
+
+	case c.nftABIs.erc1155.Events["TransferBatch"].ID:
+		var transfer erc1155.Erc1155TransferBatch
+		if err := unpackEvent(c.nftABIs.erc1155, "TransferBatch", &transfer, event); err != nil {
+			return nil, err
+		}
+		if len(transfer.Ids) != len(transfer.Values) {
+			return nil, fmt.Errorf("batch has %d ids but %d values", len(transfer.Ids), len(transfer.Values))
+		}
+
+		result := make([]*NFTTransfer, len(transfer.Ids))
+		for i := range transfer.Ids {
+			t := base
+			t.Standard = nftStandardERC1155
+			t.Operator, t.From, t.To = transfer.Operator, transfer.From, transfer.To
+			t.TokenID, t.Amount = transfer.Ids[i], transfer.Values[i]
+			t.BatchIndex = i
+			result[i] = &t
+		}
+		return result, nil
+	}
+
+	return nil, nil
+}
+
+func (c *collectorService) convertNFTTransfer(t *NFTTransfer) (NFTTransferInfo, bool) {
+	collection := c.getCollectionInfo(t.Collection.Hex())
+
+	var operator string
+	if t.Standard == nftStandardERC1155 {
+		operator = t.Operator.Hex()
+	}
+
+	return NFTTransferInfo{
+		Collection:  collection.Address,
+		Name:        collection.Name,
+		Symbol:      collection.Symbol,
+		Standard:    t.Standard,
+		Operator:    operator,
+		From:        t.From.Hex(),
+		To:          t.To.Hex(),
+		TokenID:     t.TokenID.String(),
+		Amount:      t.Amount.String(),
+		TxHash:      t.TxHash.Hex(),
+		BlockNumber: t.BlockNumber,
+		EventID:     uint16(t.EventID),
+		BatchIndex:  t.BatchIndex,
+		Watched:     c.matchedAddresses(t.From, t.To),
+	}, true
+}
+
+// collectionInfo is the name and symbol of an NFT collection.
+type collectionInfo struct {
+	Address string
+	Name    string
+	Symbol  string
+}
+
+// getCollectionInfo returns the name and symbol of the collection. Both are optional
+// in the standards, so they are left empty if the calls fail. Collections are cached
+// apart from tokens as they have no decimals. A failed lookup is cached too, as many
+// collections lack the metadata extension and would cost two calls per row.
+func (c *collectorService) getCollectionInfo(address string) collectionInfo {
+	c.mu.RLock()
+	info, ok := c.collections[address]
+	c.mu.RUnlock()
+
+	if ok {
+		return info
+	}
+
+	info = collectionInfo{Address: address}
+	nameErr := c.call("get collection name "+address, func(ctx context.Context, e *endpoint) (err error) {
+		collection, err := erc721.NewErc721Caller(common.HexToAddress(address), e.cli)
+		if err != nil {
+			return fmt.Errorf("bind collection: %w", err)
+		}
+		info.Name, err = collection.Name(&bind.CallOpts{Context: ctx})
+		return err
+	})
+	if nameErr != nil {
+		log.WithError(nameErr).WithField("collection", address).Warn("get collection name")
+	}
+
+	symbolErr := c.call("get collection symbol "+address, func(ctx context.Context, e *endpoint) (err error) {
+		collection, err := erc721.NewErc721Caller(common.HexToAddress(address), e.cli)
+		if err != nil {
+			return fmt.Errorf("bind collection: %w", err)
+		}
+		info.Symbol, err = collection.Symbol(&bind.CallOpts{Context: ctx})
+		return err
+	})
+	if symbolErr != nil {
+		log.WithError(symbolErr).WithField("collection", address).Warn("get collection symbol")
+	}
+
+	c.mu.Lock()
+	c.collections[address] = info
+	c.mu.Unlock()
+
+	return info
+}
+
+// unpackEvent parses both indexed and non-indexed arguments of the event into out.
+func unpackEvent(ABI *abi.ABI, name string, out any, event *types.Log) error {
+	if len(event.Data) > 0 {
+		if err := ABI.UnpackIntoInterface(out, name, event.Data); err != nil {
+			return fmt.Errorf("unpack event: %w", err)
+		}
+	}
+
+	var indexed abi.Arguments
+	for _, arg := range ABI.Events[name].Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+
+	if len(event.Topics) != len(indexed)+1 {
+		return fmt.Errorf("event has %d topics, expected %d", len(event.Topics), len(indexed)+1)
+	}
+	if err := abi.ParseTopics(out, indexed, event.Topics[1:]); err != nil {
+		return fmt.Errorf("parse topics: %w", err)
+	}
+
+	return nil
+}
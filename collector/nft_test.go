@@ -0,0 +1,45 @@
+package collector
+
+import (
+	"testing"
+
+	"collector/smartcontract/erc721"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGetCollectionInfo(t *testing.T) {
+	collection, bare := common.HexToAddress("0x721"), common.HexToAddress("0x1155")
+	b := newFakeBackend(t, 1)
+	c := newTestService(b)
+	c.tokens = make(map[string]tokenInfo)
+	c.collections = make(map[string]collectionInfo)
+
+	nftABI, err := erc721.Erc721MetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setCall(collection, nftABI, "name", "Apes")
+	b.setCall(collection, nftABI, "symbol", "APE")
+
+	info := c.getCollectionInfo(collection.Hex())
+	if info.Name != "Apes" || info.Symbol != "APE" {
+		t.Errorf("getCollectionInfo() = %+v", info)
+	}
+
+	// calls of a collection without the metadata extension revert
+	if info := c.getCollectionInfo(bare.Hex()); info != (collectionInfo{Address: bare.Hex()}) {
+		t.Errorf("getCollectionInfo() = %+v", info)
+	}
+
+	calls := b.calledMethods["CallContract"]
+	if c.getCollectionInfo(collection.Hex()) != info || b.calledMethods["CallContract"] != calls {
+		t.Error("collection isn't cached")
+	}
+	if c.getCollectionInfo(bare.Hex()).Name != "" || b.calledMethods["CallContract"] != calls {
+		t.Error("failed lookup isn't cached")
+	}
+	if len(c.tokens) != 0 {
+		t.Errorf("collection is cached as a token: %v", c.tokens)
+	}
+}
@@ -0,0 +1,435 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OutputFormatCSV   = "csv"
+	OutputFormatJSONL = "jsonl"
+)
+
+const bufferSize = 256
+
+type OutputConfig struct {
+	FilePath string
+	// Format is one of the OutputFormat constants.
+	Format       string
+	FlushOnWrite bool
+	InType       any
+	OutType      any
+	Converter    func(in any) (any, bool)
+	Done         chan<- struct{}
+
+	// RowGroupSize is the number of rows in a row group of the Parquet output.
+	RowGroupSize int
+	// BatchSize is the number of rows copied to PostgreSQL at once.
+	BatchSize int
+	// Driver is the database/sql driver of the PostgreSQL output, lib/pq if empty.
+	Driver string
+	// Job identifies the rows of the job in a database output and the checkpoint
+	// stored with them in PostgreSQL.
+	Job string
+	// Rotation splits csv and JSON Lines output into parts.
+	Rotation RotationConfig
+	// BlockTime returns the timestamp of a block for the daily rotation.
+	BlockTime func(block uint64) (uint64, error)
+
+	// Append keeps the first Offset bytes of an existing file and writes after them.
+	Append bool
+	Offset int64
+	// OnCheckpoint is called once all rows sent before the checkpoint are flushed.
+	OnCheckpoint func(cp checkpoint)
+	// OnError is called once the output fails. Later rows are dropped and no more
+	// checkpoints are made, so the rows are collected again on resume.
+	OnError func(err error)
+}
+
+// sink writes rows of the output.
+type sink interface {
+	write(row any) error
+	flush() error
+	// checkpoint makes the rows of the blocks up to the block durable and returns the
+	// size of the output to store in the checkpoint.
+	checkpoint(block uint64) (int64, error)
+	// rewind drops the rows written after the checkpoint.
+	rewind(cp checkpoint) error
+	close() error
+}
+
+// outputFormat returns the configured format or guesses it by the file extension.
+func outputFormat(format, filePath string) (string, error) {
+	switch strings.ToLower(format) {
+	case OutputFormatCSV:
+		return OutputFormatCSV, nil
+	case OutputFormatJSONL, "ndjson":
+		return OutputFormatJSONL, nil
+	case OutputFormatParquet:
+		return OutputFormatParquet, nil
+	case OutputFormatSQLite, "sqlite3":
+		return OutputFormatSQLite, nil
+	case OutputFormatPostgres, "postgresql":
+		return OutputFormatPostgres, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown output format %q", format)
+	}
+
+	if strings.HasPrefix(filePath, "postgres://") || strings.HasPrefix(filePath, "postgresql://") {
+		return OutputFormatPostgres, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jsonl", ".ndjson":
+		return OutputFormatJSONL, nil
+	case ".parquet":
+		return OutputFormatParquet, nil
+	case ".db", ".sqlite", ".sqlite3":
+		return OutputFormatSQLite, nil
+	default:
+		return OutputFormatCSV, nil
+	}
+}
+
+func newSink(cfg *OutputConfig) (sink, error) {
+	switch cfg.Format {
+	case OutputFormatParquet:
+		return newParquetSink(cfg)
+	case OutputFormatSQLite:
+		return newSqliteSink(cfg)
+	case OutputFormatPostgres:
+		return newPostgresSink(cfg)
+	}
+
+	if cfg.Rotation.enabled() {
+		return newRotatingSink(cfg)
+	}
+
+	file, err := openOutputFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newFileSink(cfg.Format, file, !cfg.Append || cfg.Offset == 0), nil
+}
+
+// newFileSink writes csv or JSON Lines rows to the file, header tells if the csv
+// header is written before the first row.
+func newFileSink(format string, file *outputFile, header bool) sink {
+	switch format {
+	case OutputFormatJSONL:
+		return newJSONLSink(file)
+	default:
+		return newCsvSink(file, header)
+	}
+}
+
+func runOutputService(cfg OutputConfig) (chan<- any, error) {
+	// the file path of the PostgreSQL output is a connection string
+	if cfg.Format != OutputFormatPostgres {
+		if err := os.MkdirAll(filepath.Dir(cfg.FilePath), os.ModePerm); err != nil {
+			return nil, errors.Wrap(err, "cannot create statistics directory")
+		}
+	}
+
+	msgType := reflect.TypeOf(cfg.InType)
+	w, err := newOutputWriter(msgType, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("new writer: %w", err)
+	}
+
+	msgChan := make(chan any, bufferSize)
+	go w.run(msgChan)
+
+	return msgChan, nil
+}
+
+// outputWriter converts messages to rows for the sink and handles checkpoints and rollbacks.
+type outputWriter struct {
+	sink         sink
+	outType      reflect.Type
+	converter    func(in interface{}) (any, bool)
+	flushOnWrite bool
+	done         chan<- struct{}
+	onCheckpoint func(cp checkpoint)
+	onError      func(err error)
+	history      []checkpoint
+	err          error
+}
+
+func newOutputWriter(msgType reflect.Type, cfg *OutputConfig) (w outputWriter, err error) {
+	w.flushOnWrite = cfg.FlushOnWrite
+
+	if cfg.OutType != nil {
+		w.outType = reflect.TypeOf(cfg.OutType)
+		if !msgType.ConvertibleTo(w.outType) {
+			if cfg.Converter != nil {
+				w.converter = cfg.Converter
+			} else {
+				return w, fmt.Errorf("type %s is not convertible to %s", msgType, w.outType)
+			}
+		}
+	}
+
+	w.sink, err = newSink(cfg)
+	if err != nil {
+		return w, err
+	}
+	w.done = cfg.Done
+	w.onCheckpoint = cfg.OnCheckpoint
+	w.onError = cfg.OnError
+
+	return w, nil
+}
+
+func (w *outputWriter) run(dataChan <-chan interface{}) {
+	for msg := range dataChan {
+		switch m := msg.(type) {
+		case checkpointMsg:
+			w.checkpoint(uint64(m))
+			continue
+		case rewindMsg:
+			m.reply <- w.rewind(m.block)
+			continue
+		}
+
+		// the channel is drained after a failure so that senders don't block
+		if w.err != nil {
+			continue
+		}
+
+		if w.converter != nil {
+			var ok bool
+			if msg, ok = w.converter(msg); !ok {
+				continue
+			}
+		} else if w.outType != nil {
+			msg = reflect.ValueOf(msg).Convert(w.outType).Interface()
+		}
+
+		if err := w.sink.write(msg); err != nil {
+			w.fail(fmt.Errorf("write row: %w", err))
+			continue
+		}
+
+		if w.flushOnWrite {
+			if err := w.sink.flush(); err != nil {
+				w.fail(fmt.Errorf("flush: %w", err))
+			}
+		}
+	}
+
+	w.stop()
+}
+
+// fail stops writing the output after the first error.
+func (w *outputWriter) fail(err error) {
+	if w.err != nil {
+		return
+	}
+
+	log.WithError(err).Error("output failed")
+	w.err = err
+	if w.onError != nil {
+		w.onError(err)
+	}
+}
+
+func (w *outputWriter) checkpoint(block uint64) {
+	if w.err != nil {
+		return
+	}
+
+	size, err := w.sink.checkpoint(block)
+	if err != nil {
+		w.fail(fmt.Errorf("checkpoint output: %w", err))
+		return
+	}
+
+	cp := checkpoint{Block: block, Size: size}
+	w.history = append(w.history, cp)
+	if len(w.history) > reorgDepth {
+		w.history = w.history[1:]
+	}
+
+	if w.onCheckpoint != nil {
+		w.onCheckpoint(cp)
+	}
+}
+
+// rewind truncates the output to the last checkpoint made at or before the block.
+func (w *outputWriter) rewind(block uint64) *checkpoint {
+	if w.err != nil {
+		return nil
+	}
+
+	if err := w.sink.flush(); err != nil {
+		w.fail(fmt.Errorf("flush: %w", err))
+		return nil
+	}
+
+	for i := len(w.history) - 1; i >= 0; i-- {
+		cp := w.history[i]
+		if cp.Block > block {
+			continue
+		}
+
+		if err := w.sink.rewind(cp); err != nil {
+			w.fail(fmt.Errorf("truncate output: %w", err))
+			return nil
+		}
+		w.history = w.history[:i+1]
+
+		if w.onCheckpoint != nil {
+			w.onCheckpoint(cp)
+		}
+		return &cp
+	}
+
+	return nil
+}
+
+func (w *outputWriter) stop() {
+	if err := w.sink.close(); err != nil {
+		w.fail(fmt.Errorf("close output: %w", err))
+	}
+	w.done <- struct{}{}
+}
+
+// outputFile is the buffered file of the file based sinks.
+type outputFile struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func openOutputFile(cfg *OutputConfig) (*outputFile, error) {
+	var (
+		file *os.File
+		err  error
+	)
+	if cfg.Append {
+		file, err = openForAppend(cfg.FilePath, cfg.Offset)
+	} else {
+		file, err = os.Create(cfg.FilePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create file %s: %w", cfg.FilePath, err)
+	}
+
+	return &outputFile{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (f *outputFile) flush() error {
+	return f.writer.Flush()
+}
+
+func (f *outputFile) checkpoint(uint64) (int64, error) {
+	if err := f.writer.Flush(); err != nil {
+		return 0, fmt.Errorf("flush: %w", err)
+	}
+	return f.file.Seek(0, io.SeekCurrent)
+}
+
+func (f *outputFile) rewind(cp checkpoint) error {
+	return f.truncate(cp.Size)
+}
+
+func (f *outputFile) truncate(size int64) error {
+	if err := f.writer.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := f.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+
+	f.writer.Reset(f.file)
+	return nil
+}
+
+func (f *outputFile) close() error {
+	if err := f.writer.Flush(); err != nil {
+		log.WithError(err).Error("flush")
+	}
+	return f.file.Close()
+}
+
+func openForAppend(filePath string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop rows written after the offset, they will be collected again
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+
+	return file, nil
+}
+
+// readRows decodes the rows of the output file into out, a pointer to a slice of rows.
+// A missing file has no rows.
+func readRows(filePath, format string, out any) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case OutputFormatJSONL:
+		return readJSONLRows(file, out)
+	case OutputFormatParquet, OutputFormatSQLite, OutputFormatPostgres:
+		return fmt.Errorf("reading %s output is not supported", format)
+	default:
+		return readCsvRows(file, out)
+	}
+}
+
+// writeRowsFile writes the rows, a slice of row structs, to a new csv or JSON Lines file at once.
+func writeRowsFile(filePath, format string, rows any) error {
+	switch format {
+	case OutputFormatCSV:
+		return writeCsvFile(filePath, rows)
+	case OutputFormatJSONL:
+	default:
+		return fmt.Errorf("writing %s files is not supported", format)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("create file %s: %w", filePath, err)
+	}
+
+	s := newJSONLSink(&outputFile{file: file, writer: bufio.NewWriter(file)})
+	v := reflect.ValueOf(rows)
+	for i := 0; i < v.Len(); i++ {
+		if err := s.write(v.Index(i).Interface()); err != nil {
+			file.Close()
+			return fmt.Errorf("encode: %w", err)
+		}
+	}
+	return s.close()
+}
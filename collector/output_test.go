@@ -0,0 +1,267 @@
+package collector
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testRow struct {
+	BlockNumber uint64 `csv:"block_number"`
+	TxHash      string `csv:"tx_hash"`
+	EventID     uint16 `csv:"event_id"`
+	Failed      bool   `csv:"failed"`
+}
+
+// rewindTo is a step of runOutput rewinding the output to the block.
+type rewindTo uint64
+
+// runOutput sends the rows, checkpoints and rewinds to a new output service and
+// waits for it to close. It returns the checkpoints made on the way.
+func runOutput(t *testing.T, cfg OutputConfig, steps ...any) []checkpoint {
+	t.Helper()
+
+	var checkpoints []checkpoint
+	done := make(chan struct{})
+	cfg.Done = done
+	cfg.InType, cfg.OutType = testRow{}, testRow{}
+	cfg.OnCheckpoint = func(cp checkpoint) {
+		checkpoints = append(checkpoints, cp)
+	}
+
+	msgs, err := runOutputService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		block, ok := step.(rewindTo)
+		if !ok {
+			msgs <- step
+			continue
+		}
+
+		reply := make(chan *checkpoint)
+		msgs <- rewindMsg{block: uint64(block), reply: reply}
+		if cp := <-reply; cp == nil {
+			t.Errorf("rewind to %d failed", block)
+		}
+	}
+	close(msgs)
+	<-done
+
+	return checkpoints
+}
+
+func TestFileOutput(t *testing.T) {
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01", EventID: 0},
+		{BlockNumber: 1, TxHash: "0x01", EventID: 1, Failed: true},
+		{BlockNumber: 2, TxHash: "0x02"},
+		{BlockNumber: 3, TxHash: "0x03"},
+	}
+	forked := testRow{BlockNumber: 2, TxHash: "0x0f"}
+
+	tests := []struct {
+		name  string
+		steps []any
+		want  []testRow
+	}{
+		{
+			name:  "rows",
+			steps: []any{rows[0], rows[1], checkpointMsg(1), rows[2], rows[3], checkpointMsg(3)},
+			want:  rows,
+		},
+		{
+			name:  "no rows",
+			steps: []any{checkpointMsg(1)},
+		},
+		{
+			name: "rewind",
+			steps: []any{
+				rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2), rows[3],
+				rewindTo(1), forked, checkpointMsg(2),
+			},
+			want: []testRow{rows[0], rows[1], forked},
+		},
+		{
+			name: "rewind to start",
+			steps: []any{
+				checkpointMsg(0), rows[0], rows[1], checkpointMsg(1),
+				rewindTo(0), forked,
+			},
+			want: []testRow{forked},
+		},
+	}
+	for _, format := range []string{OutputFormatCSV, OutputFormatJSONL} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "out."+format)
+				runOutput(t, OutputConfig{FilePath: path, Format: format}, tt.steps...)
+
+				var got []testRow
+				if err := readRows(path, format, &got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("rows = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestFileOutputAppend(t *testing.T) {
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01"},
+		{BlockNumber: 2, TxHash: "0x02"},
+		{BlockNumber: 3, TxHash: "0x03"},
+	}
+
+	for _, format := range []string{OutputFormatCSV, OutputFormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out."+format)
+			checkpoints := runOutput(t, OutputConfig{FilePath: path, Format: format},
+				rows[0], checkpointMsg(1), rows[1])
+			if len(checkpoints) != 1 || checkpoints[0].Block != 1 {
+				t.Fatalf("checkpoints = %+v", checkpoints)
+			}
+
+			// the row written after the checkpoint is dropped, the header is not repeated
+			runOutput(t, OutputConfig{FilePath: path, Format: format, Append: true, Offset: checkpoints[0].Size},
+				rows[2], checkpointMsg(3))
+
+			var got []testRow
+			if err := readRows(path, format, &got); err != nil {
+				t.Fatal(err)
+			}
+			if want := []testRow{rows[0], rows[2]}; !reflect.DeepEqual(got, want) {
+				t.Errorf("rows = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteRowsFile(t *testing.T) {
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01"},
+		{BlockNumber: 2, TxHash: "0x02", Failed: true},
+	}
+
+	for _, format := range []string{OutputFormatCSV, OutputFormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rows."+format)
+			if err := writeRowsFile(path, format, rows); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []testRow
+			if err := readRows(path, format, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, rows) {
+				t.Errorf("rows = %+v, want %+v", got, rows)
+			}
+		})
+	}
+
+	for _, format := range []string{OutputFormatParquet, OutputFormatSQLite, OutputFormatPostgres} {
+		t.Run(format, func(t *testing.T) {
+			if err := writeRowsFile(filepath.Join(t.TempDir(), "rows."+format), format, rows); err == nil {
+				t.Errorf("writing %s rows succeeded", format)
+			}
+		})
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "out.csv", want: OutputFormatCSV},
+		{path: "out", want: OutputFormatCSV},
+		{path: "out.ndjson", want: OutputFormatJSONL},
+		{path: "out.JSONL", want: OutputFormatJSONL},
+		{path: "out.parquet", want: OutputFormatParquet},
+		{path: "out.sqlite3", want: OutputFormatSQLite},
+		{path: "postgres://localhost/db", want: OutputFormatPostgres},
+		{format: "jsonl", path: "out.csv", want: OutputFormatJSONL},
+		{format: "CSV", path: "out.jsonl", want: OutputFormatCSV},
+		{format: "xml", path: "out.xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := outputFormat(tt.format, tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("outputFormat(%q, %q) = %q, %v, want %q", tt.format, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+// failingSink fails to write rows after the given number of rows.
+type failingSink struct {
+	rows    int
+	written int
+	closed  bool
+}
+
+func (s *failingSink) write(any) error {
+	if s.written == s.rows {
+		return errors.New("disk full")
+	}
+	s.written++
+	return nil
+}
+
+func (s *failingSink) flush() error                     { return nil }
+func (s *failingSink) checkpoint(uint64) (int64, error) { return int64(s.written), nil }
+func (s *failingSink) rewind(cp checkpoint) error       { s.written = int(cp.Size); return nil }
+func (s *failingSink) close() error                     { s.closed = true; return nil }
+
+func TestOutputWriterFailure(t *testing.T) {
+	var (
+		done        = make(chan struct{})
+		checkpoints []checkpoint
+		errs        []error
+		sink        = &failingSink{rows: 2}
+		w           = outputWriter{
+			sink: sink,
+			done: done,
+			onCheckpoint: func(cp checkpoint) {
+				checkpoints = append(checkpoints, cp)
+			},
+			onError: func(err error) {
+				errs = append(errs, err)
+			},
+		}
+	)
+
+	msgs := make(chan any)
+	go w.run(msgs)
+	msgs <- testRow{BlockNumber: 1}
+	msgs <- checkpointMsg(1)
+	msgs <- testRow{BlockNumber: 2}
+	msgs <- testRow{BlockNumber: 2}
+	msgs <- testRow{BlockNumber: 3}
+	msgs <- checkpointMsg(3)
+
+	reply := make(chan *checkpoint)
+	msgs <- rewindMsg{block: 1, reply: reply}
+	if cp := <-reply; cp != nil {
+		t.Errorf("failed output is rewound to %+v", cp)
+	}
+	close(msgs)
+	<-done
+
+	if want := []checkpoint{{Block: 1, Size: 1}}; !reflect.DeepEqual(checkpoints, want) {
+		t.Errorf("checkpoints = %+v, want %+v", checkpoints, want)
+	}
+	if len(errs) != 1 {
+		t.Errorf("errors = %v, want one", errs)
+	}
+	if sink.written != 2 || !sink.closed {
+		t.Errorf("sink = %+v", sink)
+	}
+}
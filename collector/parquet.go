@@ -0,0 +1,231 @@
+package collector
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	OutputFormatParquet = "parquet"
+
+	defaultParquetRowGroupSize = 100000
+)
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// parquetSink buffers rows and writes them in row groups. A Parquet file is only
+// readable once the footer is written on close, so the file can't be appended on
+// resume, and a reorganization can only drop rows that are not written yet. Checkpoint
+// sizes are numbers of rows.
+type parquetSink struct {
+	file         *os.File
+	writer       *writer.ParquetWriter
+	schema       *parquetSchema
+	rowGroupSize int
+
+	written int64
+	pending []any
+}
+
+// parquetSchema is a struct type with parquet tags mirroring a row type. Columns keep
+// the csv names, wei amounts stay strings as uint256 doesn't fit the decimal type.
+type parquetSchema struct {
+	rowType reflect.Type
+	fields  []parquetField
+	typ     reflect.Type
+}
+
+type parquetField struct {
+	index     int
+	timestamp bool
+}
+
+func newParquetSink(cfg *OutputConfig) (*parquetSink, error) {
+	rowType := reflect.TypeOf(cfg.OutType)
+	if rowType == nil {
+		rowType = reflect.TypeOf(cfg.InType)
+	}
+	schema, err := newParquetSchema(rowType)
+	if err != nil {
+		return nil, fmt.Errorf("derive schema: %w", err)
+	}
+
+	file, err := os.Create(cfg.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("create file %s: %w", cfg.FilePath, err)
+	}
+
+	pw, err := writer.NewParquetWriterFromWriter(file, reflect.New(schema.typ).Interface(), 1)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("new parquet writer: %w", err)
+	}
+
+	rowGroupSize := cfg.RowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = defaultParquetRowGroupSize
+	}
+
+	return &parquetSink{file: file, writer: pw, schema: schema, rowGroupSize: rowGroupSize}, nil
+}
+
+func newParquetSchema(rowType reflect.Type) (*parquetSchema, error) {
+	if rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("row of type %s is not a struct", rowType)
+	}
+
+	s := parquetSchema{rowType: rowType}
+	var fields []reflect.StructField
+	for _, f := range rowFields(rowType) {
+		var (
+			field = parquetField{index: f.index}
+			typ   reflect.Type
+			tag   string
+		)
+
+		goType := rowType.Field(f.index).Type
+		switch {
+		case f.name == "timestamp" && goType.Kind() == reflect.Uint64:
+			field.timestamp = true
+			typ, tag = reflect.TypeOf(int64(0)), "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+		case goType.Implements(textMarshalerType):
+			typ, tag = reflect.TypeOf(""), "type=BYTE_ARRAY, convertedtype=UTF8"
+		default:
+			switch goType.Kind() {
+			case reflect.String:
+				typ, tag = reflect.TypeOf(""), "type=BYTE_ARRAY, convertedtype=UTF8"
+			case reflect.Bool:
+				typ, tag = reflect.TypeOf(false), "type=BOOLEAN"
+			case reflect.Uint8:
+				typ, tag = reflect.TypeOf(int32(0)), "type=INT32, convertedtype=UINT_8"
+			case reflect.Uint16:
+				typ, tag = reflect.TypeOf(int32(0)), "type=INT32, convertedtype=UINT_16"
+			case reflect.Uint32:
+				typ, tag = reflect.TypeOf(int32(0)), "type=INT32, convertedtype=UINT_32"
+			case reflect.Uint64, reflect.Uint:
+				typ, tag = reflect.TypeOf(int64(0)), "type=INT64, convertedtype=UINT_64"
+			case reflect.Int8, reflect.Int16, reflect.Int32:
+				typ, tag = reflect.TypeOf(int32(0)), "type=INT32"
+			case reflect.Int64, reflect.Int:
+				typ, tag = reflect.TypeOf(int64(0)), "type=INT64"
+			default:
+				return nil, fmt.Errorf("column %s of type %s is not supported", f.name, goType)
+			}
+		}
+
+		s.fields = append(s.fields, field)
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("F%d", len(fields)),
+			Type: typ,
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"name=%s, %s, repetitiontype=REQUIRED"`, f.name, tag)),
+		})
+	}
+	s.typ = reflect.StructOf(fields)
+
+	return &s, nil
+}
+
+// convert copies the row into the parquet struct.
+func (s *parquetSchema) convert(row any) (any, error) {
+	v := reflect.ValueOf(row)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Type() != s.rowType {
+		return nil, fmt.Errorf("row of type %s doesn't match schema of %s", v.Type(), s.rowType)
+	}
+
+	out := reflect.New(s.typ).Elem()
+	for i, f := range s.fields {
+		src, dst := v.Field(f.index), out.Field(i)
+		switch {
+		case f.timestamp:
+			dst.SetInt(int64(src.Uint()) * 1000)
+		case dst.Kind() == reflect.String && src.Kind() != reflect.String:
+			text, err := src.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			dst.SetString(string(text))
+		case dst.Kind() == reflect.String:
+			dst.SetString(src.String())
+		case dst.Kind() == reflect.Bool:
+			dst.SetBool(src.Bool())
+		case src.CanUint():
+			dst.SetInt(int64(src.Uint()))
+		default:
+			dst.SetInt(src.Int())
+		}
+	}
+	return out.Interface(), nil
+}
+
+func (s *parquetSink) write(row any) error {
+	pRow, err := s.schema.convert(row)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pRow)
+	return nil
+}
+
+// flush is a no-op, rows are written in row groups at checkpoints.
+func (s *parquetSink) flush() error {
+	return nil
+}
+
+// checkpoint writes a row group once enough rows are buffered. Row groups end at
+// checkpoints, so the rows of a block are never split between them.
+func (s *parquetSink) checkpoint(uint64) (int64, error) {
+	if len(s.pending) >= s.rowGroupSize {
+		if err := s.writeRowGroup(); err != nil {
+			return 0, err
+		}
+	}
+	return s.written + int64(len(s.pending)), nil
+}
+
+func (s *parquetSink) rewind(cp checkpoint) error {
+	if cp.Size < s.written {
+		return fmt.Errorf("rows before %d are already written to row groups", s.written)
+	}
+	s.pending = s.pending[:cp.Size-s.written]
+	return nil
+}
+
+func (s *parquetSink) writeRowGroup() error {
+	for _, row := range s.pending {
+		if err := s.writer.Write(row); err != nil {
+			return fmt.Errorf("write row: %w", err)
+		}
+	}
+	if err := s.writer.Flush(true); err != nil {
+		return fmt.Errorf("flush row group: %w", err)
+	}
+
+	s.written += int64(len(s.pending))
+	s.pending = s.pending[:0]
+	return nil
+}
+
+// close writes the rest of the rows and the footer.
+func (s *parquetSink) close() error {
+	if len(s.pending) > 0 {
+		if err := s.writeRowGroup(); err != nil {
+			log.WithError(err).Error("write row group")
+		}
+	}
+	if err := s.writer.WriteStop(); err != nil {
+		s.file.Close()
+		return fmt.Errorf("write footer: %w", err)
+	}
+	return s.file.Close()
+}
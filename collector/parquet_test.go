@@ -0,0 +1,161 @@
+package collector
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+type parquetTestRow struct {
+	BlockNumber uint64 `csv:"block_number"`
+	Timestamp   uint64 `csv:"timestamp"`
+	TxHash      string `csv:"tx_hash"`
+	EventID     uint16 `csv:"event_id"`
+	Failed      bool   `csv:"failed"`
+	Amount      eventArg
+	Skipped     string `csv:"-"`
+}
+
+// readParquetRows reads the rows of the file as the structs of the schema.
+func readParquetRows(t *testing.T, path string, schema *parquetSchema) []any {
+	t.Helper()
+
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	pr, err := reader.NewParquetReader(file, reflect.New(schema.typ).Interface(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	// the reader fills the length of the slice
+	out := reflect.New(reflect.SliceOf(schema.typ))
+	out.Elem().Set(reflect.MakeSlice(out.Elem().Type(), int(pr.GetNumRows()), int(pr.GetNumRows())))
+	if err := pr.Read(out.Interface()); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []any
+	for i := 0; i < out.Elem().Len(); i++ {
+		rows = append(rows, out.Elem().Index(i).Interface())
+	}
+	return rows
+}
+
+func TestParquetSchema(t *testing.T) {
+	schema, err := newParquetSchema(reflect.TypeOf(parquetTestRow{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []string
+	for i := 0; i < schema.typ.NumField(); i++ {
+		tags = append(tags, schema.typ.Field(i).Tag.Get("parquet"))
+	}
+	want := []string{
+		"name=block_number, type=INT64, convertedtype=UINT_64, repetitiontype=REQUIRED",
+		"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED",
+		"name=tx_hash, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED",
+		"name=event_id, type=INT32, convertedtype=UINT_16, repetitiontype=REQUIRED",
+		"name=failed, type=BOOLEAN, repetitiontype=REQUIRED",
+		"name=Amount, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED",
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %q, want %q", tags, want)
+	}
+
+	if _, err := newParquetSchema(reflect.TypeOf(struct{ Values []string }{})); err == nil {
+		t.Error("schema of a slice column is derived")
+	}
+}
+
+func TestParquetOutput(t *testing.T) {
+	schema, err := newParquetSchema(reflect.TypeOf(testRow{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01", EventID: 0},
+		{BlockNumber: 1, TxHash: "0x01", EventID: 1, Failed: true},
+		{BlockNumber: 2, TxHash: "0x02"},
+		{BlockNumber: 3, TxHash: "0x03"},
+	}
+	forked := testRow{BlockNumber: 3, TxHash: "0x0f"}
+
+	tests := []struct {
+		name         string
+		rowGroupSize int
+		steps        []any
+		want         []testRow
+		checkpoints  []checkpoint
+	}{
+		{
+			name:         "row groups at checkpoints",
+			rowGroupSize: 2,
+			steps:        []any{rows[0], checkpointMsg(0), rows[1], checkpointMsg(1), rows[2], rows[3], checkpointMsg(3)},
+			want:         rows,
+			checkpoints:  []checkpoint{{Block: 0, Size: 1}, {Block: 1, Size: 2}, {Block: 3, Size: 4}},
+		},
+		{
+			name:         "rewind pending rows",
+			rowGroupSize: 3,
+			steps: []any{
+				rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2), rows[3],
+				rewindTo(2), forked, checkpointMsg(3),
+			},
+			want:        []testRow{rows[0], rows[1], rows[2], forked},
+			checkpoints: []checkpoint{{Block: 1, Size: 2}, {Block: 2, Size: 3}, {Block: 2, Size: 3}, {Block: 3, Size: 4}},
+		},
+		{
+			name:  "no rows",
+			steps: []any{checkpointMsg(1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.parquet")
+			checkpoints := runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatParquet, RowGroupSize: tt.rowGroupSize}, tt.steps...)
+			if len(tt.checkpoints) > 0 && !reflect.DeepEqual(checkpoints, tt.checkpoints) {
+				t.Errorf("checkpoints = %+v, want %+v", checkpoints, tt.checkpoints)
+			}
+
+			var want []any
+			for _, row := range tt.want {
+				pRow, err := schema.convert(row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, pRow)
+			}
+			if got := readParquetRows(t, path, schema); !reflect.DeepEqual(got, want) {
+				t.Errorf("rows = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParquetRewindWrittenRows(t *testing.T) {
+	s, err := newParquetSink(&OutputConfig{FilePath: filepath.Join(t.TempDir(), "out.parquet"), InType: testRow{}, RowGroupSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if err := s.write(testRow{BlockNumber: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := s.checkpoint(1); err != nil || size != 1 {
+		t.Fatalf("checkpoint() = %d, %v", size, err)
+	}
+	if err := s.rewind(checkpoint{Block: 0, Size: 0}); err == nil {
+		t.Error("rows of a written row group are rewound")
+	}
+}
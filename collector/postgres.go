@@ -0,0 +1,348 @@
+package collector
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	OutputFormatPostgres = "postgres"
+
+	defaultPostgresBatchSize = 10000
+	// postgresCommitInterval bounds how long rows wait for a full batch in follow mode.
+	postgresCommitInterval = 10 * time.Second
+)
+
+// defaultPostgresDriver is the database/sql driver registered by lib/pq.
+const defaultPostgresDriver = "postgres"
+
+const createCheckpointsTable = `CREATE TABLE IF NOT EXISTS collector_checkpoints (
+	job TEXT PRIMARY KEY,
+	block BIGINT NOT NULL
+)`
+
+// postgresSink buffers rows and copies them to PostgreSQL in batches. A batch is
+// committed in one transaction with the checkpoint of its last block, so the database
+// never holds rows without a matching checkpoint and the job resumes from the
+// checkpoint stored there. Batches are copied to a staging table and upserted,
+// so rows of blocks collected again replace the earlier ones.
+type postgresSink struct {
+	db      *sql.DB
+	job     string
+	table   dbTable
+	rowType reflect.Type
+	fields  []rowField
+	columns []string
+	// blockField is the index of the block_number field of the row.
+	blockField int
+	batchSize  int
+
+	pending []pendingRow
+	// checkpointed is the number of pending rows up to the last checkpoint.
+	checkpointed int
+	block        uint64
+	hasBlock     bool
+	committed    uint64
+	committedAt  time.Time
+}
+
+type pendingRow struct {
+	block  uint64
+	values []any
+}
+
+func newPostgresSink(cfg *OutputConfig) (*postgresSink, error) {
+	rowType := reflect.TypeOf(cfg.OutType)
+	if rowType == nil {
+		rowType = reflect.TypeOf(cfg.InType)
+	}
+	if rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+
+	table, err := tableOf(rowType)
+	if err != nil {
+		return nil, err
+	}
+	s := postgresSink{job: cfg.Job, table: table, rowType: rowType, fields: rowFields(rowType), batchSize: cfg.BatchSize}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultPostgresBatchSize
+	}
+
+	s.blockField = -1
+	s.columns = []string{jobColumn}
+	definitions := []string{fmt.Sprintf("%q TEXT NOT NULL", jobColumn)}
+	for _, f := range s.fields {
+		s.columns = append(s.columns, f.name)
+		definitions = append(definitions, fmt.Sprintf("%q %s NOT NULL", f.name, postgresType(rowType.Field(f.index).Type)))
+		if f.name == "block_number" {
+			s.blockField = f.index
+		}
+	}
+	if s.blockField < 0 {
+		return nil, fmt.Errorf("row of type %s has no block_number column", rowType)
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+
+	existing, err := postgresColumns(db, table.name)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read columns of table %s: %w", table.name, err)
+	}
+	if err := checkColumns(table.name, existing, s.columns); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	statements := []string{
+		createCheckpointsTable,
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, PRIMARY KEY (%s))",
+			table.name, strings.Join(definitions, ", "), quoteColumns(table.key)),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_block_number ON %s (%q, block_number)", table.name, table.name, jobColumn),
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+
+	return &s, nil
+}
+
+// postgresColumns returns the columns of the table in the current schema, none if
+// it doesn't exist.
+func postgresColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+func postgresType(t reflect.Type) string {
+	if t.Implements(textMarshalerType) {
+		return "TEXT"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "BOOLEAN"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "INTEGER"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "BIGINT"
+	default:
+		return "TEXT"
+	}
+}
+
+// openPostgres opens the database of the output with its driver.
+func openPostgres(cfg *OutputConfig) (*sql.DB, error) {
+	driver := cfg.Driver
+	if driver == "" {
+		driver = defaultPostgresDriver
+	}
+	db, err := sql.Open(driver, cfg.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	return db, nil
+}
+
+// loadPostgresCheckpoint returns the block of the last batch committed by the job
+// to the database of the output.
+func loadPostgresCheckpoint(cfg *OutputConfig, job string) (uint64, bool, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 0, false, err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(createCheckpointsTable); err != nil {
+		return 0, false, fmt.Errorf("create table collector_checkpoints: %w", err)
+	}
+
+	var block int64
+	err = db.QueryRow("SELECT block FROM collector_checkpoints WHERE job = $1", job).Scan(&block)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return uint64(block), true, nil
+}
+
+func (s *postgresSink) write(row any) error {
+	v := reflect.ValueOf(row)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Type() != s.rowType {
+		return fmt.Errorf("row of type %s doesn't match table of %s", v.Type(), s.rowType)
+	}
+
+	values, err := rowValues(v, s.fields)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pendingRow{block: v.Field(s.blockField).Uint(), values: append([]any{s.job}, values...)})
+	return nil
+}
+
+// flush is a no-op, rows are committed in batches at checkpoints.
+func (s *postgresSink) flush() error {
+	return nil
+}
+
+// checkpoint commits the batch once it is full or old enough. The size is always
+// zero as the checkpoint is kept in the database.
+func (s *postgresSink) checkpoint(block uint64) (int64, error) {
+	s.checkpointed = len(s.pending)
+	s.block, s.hasBlock = block, true
+
+	if len(s.pending) < s.batchSize && time.Since(s.committedAt) < postgresCommitInterval {
+		return 0, nil
+	}
+	return 0, s.commit()
+}
+
+// commit copies the rows up to the last checkpoint and stores the checkpoint in one transaction.
+func (s *postgresSink) commit() error {
+	rows := s.pending[:s.checkpointed]
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if len(rows) > 0 {
+		stage := s.table.name + "_stage"
+		create := fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", stage, s.table.name)
+		if _, err := tx.Exec(create); err != nil {
+			return fmt.Errorf("create staging table: %w", err)
+		}
+
+		stmt, err := tx.Prepare(pq.CopyIn(stage, s.columns...))
+		if err != nil {
+			return fmt.Errorf("prepare copy: %w", err)
+		}
+		for _, row := range rows {
+			if _, err := stmt.Exec(row.values...); err != nil {
+				stmt.Close()
+				return fmt.Errorf("copy row: %w", err)
+			}
+		}
+		if _, err := stmt.Exec(); err != nil {
+			stmt.Close()
+			return fmt.Errorf("copy: %w", err)
+		}
+		if err := stmt.Close(); err != nil {
+			return fmt.Errorf("close copy: %w", err)
+		}
+
+		// a key is upserted at most once per statement
+		columns := quoteColumns(s.columns)
+		upsert := fmt.Sprintf("INSERT INTO %s (%s) SELECT DISTINCT ON (%s) %s FROM %s %s",
+			s.table.name, columns, quoteColumns(s.table.key), columns, stage, upsertClause(s.table, s.columns))
+		if _, err := tx.Exec(upsert); err != nil {
+			return fmt.Errorf("upsert rows: %w", err)
+		}
+	}
+
+	if err := s.saveCheckpoint(tx, s.block); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	s.pending = append(s.pending[:0], s.pending[s.checkpointed:]...)
+	s.checkpointed = 0
+	s.committed = s.block
+	s.committedAt = time.Now()
+	return nil
+}
+
+func (s *postgresSink) saveCheckpoint(tx *sql.Tx, block uint64) error {
+	_, err := tx.Exec(`INSERT INTO collector_checkpoints (job, block) VALUES ($1, $2)
+		ON CONFLICT (job) DO UPDATE SET block = excluded.block`, s.job, int64(block))
+	if err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// rewind drops the pending rows after the checkpoint, and the committed rows of the
+// job with the checkpoint moved back if the batch of the block is already committed.
+func (s *postgresSink) rewind(cp checkpoint) error {
+	n := 0
+	for _, row := range s.pending {
+		if row.block <= cp.Block {
+			s.pending[n] = row
+			n++
+		}
+	}
+	s.pending = s.pending[:n]
+	s.checkpointed = n
+	s.block = cp.Block
+
+	if s.committed <= cp.Block {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	deleteRows := fmt.Sprintf("DELETE FROM %s WHERE %q = $1 AND block_number > $2", s.table.name, jobColumn)
+	if _, err := tx.Exec(deleteRows, s.job, int64(cp.Block)); err != nil {
+		return fmt.Errorf("delete rows: %w", err)
+	}
+	if err := s.saveCheckpoint(tx, cp.Block); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	s.committed = cp.Block
+	return nil
+}
+
+// close commits the rows up to the last checkpoint, the rows after it are
+// collected again on resume.
+func (s *postgresSink) close() error {
+	if s.hasBlock {
+		if err := s.commit(); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+	return s.db.Close()
+}
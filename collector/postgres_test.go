@@ -0,0 +1,296 @@
+package collector
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// postgresTestDSNEnv names the variable holding the connection string of a PostgreSQL
+// server the tests may create schemas in, e.g. of a container started with
+//
+//	docker run --rm -e POSTGRES_PASSWORD=test -p 5432:5432 postgres
+//
+// The PostgreSQL tests are skipped if it is not set.
+const postgresTestDSNEnv = "COLLECTOR_TEST_POSTGRES_DSN"
+
+// newPostgresTestDB creates a schema of its own for the test and returns the database
+// with a connection string that puts the tables of the output into the schema.
+func newPostgresTestDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+
+	dsn := os.Getenv(postgresTestDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresTestDSNEnv)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	schema := "collector_test_" + hex.EncodeToString(id)
+
+	// lib/pq passes unknown parameters on to the server
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	db, err := sql.Open(defaultPostgresDriver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	return db, dsn
+}
+
+func pgTestRows(t *testing.T, db *sql.DB, job string) []testRow {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT block_number, tx_hash, event_id, failed FROM events
+		WHERE job = $1 ORDER BY block_number, tx_hash, event_id`, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var result []testRow
+	for rows.Next() {
+		var row testRow
+		if err := rows.Scan(&row.BlockNumber, &row.TxHash, &row.EventID, &row.Failed); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func pgTestCheckpoint(t *testing.T, dsn, job string) uint64 {
+	t.Helper()
+
+	block, ok, err := loadPostgresCheckpoint(&OutputConfig{FilePath: dsn}, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("no checkpoint of job %s", job)
+	}
+	return block
+}
+
+func TestPostgresOutput(t *testing.T) {
+	t.Parallel()
+
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01", EventID: 0},
+		{BlockNumber: 1, TxHash: "0x01", EventID: 1},
+		{BlockNumber: 2, TxHash: "0x02"},
+		{BlockNumber: 3, TxHash: "0x03"},
+	}
+	forked := testRow{BlockNumber: 2, TxHash: "0x0f"}
+
+	tests := []struct {
+		name       string
+		batchSize  int
+		runs       [][]any
+		want       []testRow
+		checkpoint uint64
+	}{
+		{
+			name:       "commit batches",
+			batchSize:  2,
+			runs:       [][]any{{rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2), rows[3], checkpointMsg(3)}},
+			want:       rows,
+			checkpoint: 3,
+		},
+		{
+			name:       "uncheckpointed rows are not committed",
+			batchSize:  100,
+			runs:       [][]any{{rows[0], rows[1], checkpointMsg(1), rows[2]}},
+			want:       rows[:2],
+			checkpoint: 1,
+		},
+		{
+			name:      "rewind committed batches",
+			batchSize: 1,
+			runs: [][]any{{
+				rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2), rows[3], checkpointMsg(3),
+				rewindTo(1), forked, checkpointMsg(2),
+			}},
+			want:       []testRow{rows[0], rows[1], forked},
+			checkpoint: 2,
+		},
+		{
+			name:      "rewind pending rows",
+			batchSize: 100,
+			runs: [][]any{{
+				rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2),
+				rewindTo(1), forked, checkpointMsg(2),
+			}},
+			want:       []testRow{rows[0], rows[1], forked},
+			checkpoint: 2,
+		},
+		{
+			name:      "upsert rows collected again",
+			batchSize: 1,
+			runs: [][]any{
+				{rows[0], rows[1], checkpointMsg(1), rows[2]},
+				{rows[2], checkpointMsg(2), rows[3], checkpointMsg(3)},
+			},
+			want:       rows,
+			checkpoint: 3,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db, dsn := newPostgresTestDB(t)
+			for _, steps := range tt.runs {
+				runOutput(t, OutputConfig{FilePath: dsn, Format: OutputFormatPostgres, Job: "job", BatchSize: tt.batchSize}, steps...)
+			}
+
+			if got := pgTestRows(t, db, "job"); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rows = %+v, want %+v", got, tt.want)
+			}
+			if block := pgTestCheckpoint(t, dsn, "job"); block != tt.checkpoint {
+				t.Errorf("checkpoint = %d, want %d", block, tt.checkpoint)
+			}
+		})
+	}
+}
+
+func TestPostgresOutputSharedTable(t *testing.T) {
+	t.Parallel()
+	db, dsn := newPostgresTestDB(t)
+
+	rows := []testRow{{BlockNumber: 1, TxHash: "0x01"}, {BlockNumber: 2, TxHash: "0x02"}}
+	runOutput(t, OutputConfig{FilePath: dsn, Format: OutputFormatPostgres, Job: "a", BatchSize: 1},
+		rows[0], checkpointMsg(1), rows[1], checkpointMsg(2))
+	// the same rows of another job are kept apart and its rewind leaves the first job alone
+	runOutput(t, OutputConfig{FilePath: dsn, Format: OutputFormatPostgres, Job: "b", BatchSize: 1},
+		rows[0], checkpointMsg(1), rows[1], checkpointMsg(2), rewindTo(1))
+
+	if got := pgTestRows(t, db, "a"); fmt.Sprint(got) != fmt.Sprint(rows) {
+		t.Errorf("rows of job a = %+v, want %+v", got, rows)
+	}
+	if got := pgTestRows(t, db, "b"); fmt.Sprint(got) != fmt.Sprint(rows[:1]) {
+		t.Errorf("rows of job b = %+v, want %+v", got, rows[:1])
+	}
+	if a, b := pgTestCheckpoint(t, dsn, "a"), pgTestCheckpoint(t, dsn, "b"); a != 2 || b != 1 {
+		t.Errorf("checkpoints = %d, %d, want 2, 1", a, b)
+	}
+}
+
+func TestPostgresOutputColumnsChanged(t *testing.T) {
+	t.Parallel()
+	_, dsn := newPostgresTestDB(t)
+	runOutput(t, OutputConfig{FilePath: dsn, Format: OutputFormatPostgres, Job: "job"}, testRow{BlockNumber: 1}, checkpointMsg(1))
+
+	type otherRow struct {
+		BlockNumber uint64 `csv:"block_number"`
+		TxHash      string `csv:"tx_hash"`
+		EventID     uint16 `csv:"event_id"`
+	}
+	s, err := newPostgresSink(&OutputConfig{FilePath: dsn, InType: otherRow{}, Job: "job"})
+	if err == nil {
+		s.close()
+		t.Fatal("rows with other columns are written to the events table")
+	}
+}
+
+func TestPostgresOutputDriver(t *testing.T) {
+	_, err := newPostgresSink(&OutputConfig{FilePath: "postgres://localhost/db", InType: testRow{}, Driver: "unknown"})
+	if err == nil || !strings.Contains(err.Error(), `unknown driver "unknown"`) {
+		t.Errorf("err = %v, want unknown driver", err)
+	}
+}
+
+func TestRunResumesFromPostgresCheckpoint(t *testing.T) {
+	t.Parallel()
+	db, dsn := newPostgresTestDB(t)
+
+	key := mustKey(t)
+	watched, other := crypto.PubkeyToAddress(key.PublicKey), common.HexToAddress("0x1234")
+	b := newFakeBackend(t, 0)
+	for i := 0; i < 12; i++ {
+		var txs []fakeTx
+		if i%2 == 1 {
+			txs = []fakeTx{{key: key, to: &other, value: int64(i), nonce: uint64(i / 2)}}
+		}
+		b.addBlock(txs)
+	}
+
+	cfg := testConfig(t, "")
+	cfg.OutputFilePath = dsn
+	cfg.OutputFormat = OutputFormatPostgres
+	cfg.Address = watched.Hex()
+	cfg.ToBlock = 5
+	if err := RunWithBackend(context.Background(), cfg, b); err != nil {
+		t.Fatal(err)
+	}
+	job := jobKey(cfg)
+	if block := pgTestCheckpoint(t, dsn, job); block != 5 {
+		t.Fatalf("checkpoint = %d, want 5", block)
+	}
+
+	calls := b.calledMethods["BlockByNumber"]
+	cfg.ToBlock = 10
+	if err := RunWithBackend(context.Background(), cfg, b); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.calledMethods["BlockByNumber"] - calls; n != 5 {
+		t.Errorf("resumed run fetched %d blocks, want 5", n)
+	}
+	if block := pgTestCheckpoint(t, dsn, job); block != 10 {
+		t.Errorf("checkpoint = %d, want 10", block)
+	}
+
+	rows, err := db.Query("SELECT block_number FROM transactions WHERE job = $1 ORDER BY block_number", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var blocks []int64
+	for rows.Next() {
+		var block int64
+		if err := rows.Scan(&block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	if fmt.Sprint(blocks) != "[1 3 5 7 9]" {
+		t.Errorf("blocks of rows = %v", blocks)
+	}
+}
@@ -0,0 +1,26 @@
+package collector
+
+import (
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+type RateLimitConfig struct {
+	// RequestsPerSecond is the max average rate of RPC requests, no limit if zero.
+	RequestsPerSecond float64 `yaml:"RequestsPerSecond"`
+	// Burst is the max number of requests sent at once, defaults to a tenth of the rate.
+	Burst int `yaml:"Burst"`
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rate.Limiter {
+	if cfg.RequestsPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(cfg.RequestsPerSecond/10)))
+	}
+	return rate.NewLimiter(rate.Limit(cfg.RequestsPerSecond), burst)
+}
@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	log "github.com/sirupsen/logrus"
+)
+
+// blockReceiptsThreshold is the min number of txs of a block whose receipts are
+// fetched at once with eth_getBlockReceipts instead of one by one.
+const blockReceiptsThreshold = 2
+
+// receipts returns receipts of the txs of the block by tx hash. Receipts missing
+// from a null or partial eth_getBlockReceipts response are fetched one by one,
+// and an error is returned unless every tx has its receipt.
+func (c *collectorService) receipts(block *types.Block, txs []*types.Transaction) (map[common.Hash]*types.Receipt, error) {
+	receipts := make(map[common.Hash]*types.Receipt, len(txs))
+
+	if len(txs) >= blockReceiptsThreshold && !c.noBlockReceipts {
+		var all []*types.Receipt
+		err := c.call(fmt.Sprintf("get block receipts %d", block.Number()), func(ctx context.Context, e *endpoint) (err error) {
+			all, err = e.cli.BlockReceipts(ctx, block.Number())
+			return err
+		})
+		switch {
+		case err == nil:
+			for _, r := range all {
+				// receipts of another block are left by a reorganization
+				if r != nil && r.BlockHash == block.Hash() {
+					receipts[r.TxHash] = r
+				}
+			}
+		case isMethodNotFound(err):
+			log.WithError(err).Warn("block receipts are not supported, fetch receipts one by one")
+			c.noBlockReceipts = true
+		default:
+			return nil, fmt.Errorf("get block receipts %d: %w", block.Number(), err)
+		}
+	}
+
+	for _, tx := range txs {
+		if _, ok := receipts[tx.Hash()]; ok {
+			continue
+		}
+
+		r, err := c.txReceipt(tx.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("get receipt %s: %w", tx.Hash().Hex(), err)
+		}
+		if r == nil || r.BlockHash != block.Hash() {
+			return nil, fmt.Errorf("no receipt of tx %s in block %d", tx.Hash().Hex(), block.Number())
+		}
+		receipts[tx.Hash()] = r
+	}
+
+	return receipts, nil
+}
+
+func (c *collectorService) txReceipt(hash common.Hash) (receipt *types.Receipt, err error) {
+	err = c.call("get receipt "+hash.Hex(), func(ctx context.Context, e *endpoint) (err error) {
+		receipt, err = e.cli.TransactionReceipt(ctx, hash)
+		return err
+	})
+	return receipt, err
+}
+
+func isMethodNotFound(err error) bool {
+	const methodNotFoundCode = -32601
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == methodNotFoundCode {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "method not found") ||
+		strings.Contains(msg, "does not exist") ||
+		strings.Contains(msg, "not supported")
+}
+
+// effectiveGasPrice returns the price per gas paid by the tx. Old nodes do not
+// return it in receipts, so it is derived from the tx and the block base fee.
+func effectiveGasPrice(tx *types.Transaction, receipt *types.Receipt, baseFee *big.Int) *big.Int {
+	if receipt.EffectiveGasPrice != nil {
+		return receipt.EffectiveGasPrice
+	}
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+	return new(big.Int).Add(tx.EffectiveGasTipValue(baseFee), baseFee)
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestReceipts(t *testing.T) {
+	tests := []struct {
+		name          string
+		blockReceipts func([]*types.Receipt) []*types.Receipt
+		fail          func(method string, number *big.Int) error
+		txReceipts    int
+		wantErr       bool
+	}{
+		{name: "block receipts"},
+		{
+			name:          "null",
+			blockReceipts: func([]*types.Receipt) []*types.Receipt { return nil },
+			txReceipts:    3,
+		},
+		{
+			name:          "partial",
+			blockReceipts: func(r []*types.Receipt) []*types.Receipt { return r[:1] },
+			txReceipts:    2,
+		},
+		{
+			name:          "null entries",
+			blockReceipts: func(r []*types.Receipt) []*types.Receipt { r[1] = nil; return r },
+			txReceipts:    1,
+		},
+		{
+			name: "other block",
+			blockReceipts: func(r []*types.Receipt) []*types.Receipt {
+				stale := *r[2]
+				stale.BlockHash = common.Hash{1}
+				r[2] = &stale
+				return r
+			},
+			txReceipts: 1,
+		},
+		{
+			name: "not supported",
+			fail: func(method string, _ *big.Int) error {
+				if method == "BlockReceipts" {
+					return errors.New("the method eth_getBlockReceipts does not exist/is not available")
+				}
+				return nil
+			},
+			txReceipts: 3,
+		},
+		{
+			name:          "missing tx receipt",
+			blockReceipts: func([]*types.Receipt) []*types.Receipt { return nil },
+			fail: func(method string, _ *big.Int) error {
+				if method == "TransactionReceipt" {
+					return ethereum.NotFound
+				}
+				return nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := mustKey(t)
+			to := common.HexToAddress("0xa")
+			b := newFakeBackend(t, 1)
+			block := b.addBlock([]fakeTx{{key: key, to: &to}, {key: key, to: &to, nonce: 1}, {key: key, to: &to, nonce: 2}})
+			b.blockReceipts, b.fail = tt.blockReceipts, tt.fail
+			c := newTestService(b)
+
+			receipts, err := c.receipts(block, block.Transactions())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("receipts() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tx := range block.Transactions() {
+				r := receipts[tx.Hash()]
+				if r == nil || r.TxHash != tx.Hash() || r.BlockHash != block.Hash() {
+					t.Errorf("receipt of tx %s = %+v", tx.Hash().Hex(), r)
+				}
+			}
+			if calls := b.calledMethods["TransactionReceipt"]; calls != tt.txReceipts {
+				t.Errorf("%d receipts fetched one by one, want %d", calls, tt.txReceipts)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// reorgDepth is the number of recent blocks and checkpoints kept to roll back a reorganization.
+const reorgDepth = 128
+
+// rewindMsg asks the csv service to drop rows of the blocks after the block.
+// The service replies with the checkpoint it rolled back to or nil if there is none.
+type rewindMsg struct {
+	block uint64
+	reply chan<- *checkpoint
+}
+
+type blockHashes struct {
+	hashes map[uint64]common.Hash
+}
+
+func newBlockHashes() *blockHashes {
+	return &blockHashes{hashes: make(map[uint64]common.Hash)}
+}
+
+// add records the hash of the block and forgets the blocks more than reorgDepth below it.
+func (h *blockHashes) add(num uint64, hash common.Hash) {
+	h.hashes[num] = hash
+	if num < reorgDepth {
+		return
+	}
+	for n := range h.hashes {
+		if n < num-reorgDepth {
+			delete(h.hashes, n)
+		}
+	}
+}
+
+func (h *blockHashes) get(num uint64) (common.Hash, bool) {
+	hash, ok := h.hashes[num]
+	return hash, ok
+}
+
+func (h *blockHashes) dropAfter(num uint64) {
+	for n := range h.hashes {
+		if n > num {
+			delete(h.hashes, n)
+		}
+	}
+}
+
+// checkReorg compares the parent hash of the header with the hash of the previous block
+// seen before. On mismatch it rolls back the output to the last checkpoint before the
+// common ancestor and returns the block to continue from.
+func (c *collectorService) checkReorg(header *types.Header) (next uint64, reorg bool, err error) {
+	num := header.Number.Uint64()
+
+	parent, ok := c.hashes.get(num - 1)
+	if num == 0 || !ok || parent == header.ParentHash {
+		c.hashes.add(num, header.Hash())
+		return 0, false, nil
+	}
+
+	ancestor, err := c.findAncestor(header)
+	if err != nil {
+		return 0, false, fmt.Errorf("find common ancestor: %w", err)
+	}
+
+	reply := make(chan *checkpoint)
+	c.msgChan <- rewindMsg{block: ancestor, reply: reply}
+	cp := <-reply
+	if cp == nil {
+		return 0, false, fmt.Errorf("no checkpoint before block %d", ancestor)
+	}
+
+	c.hashes.dropAfter(cp.Block)
+	if c.onRewind != nil {
+		if err := c.onRewind(); err != nil {
+			return 0, false, fmt.Errorf("roll back to block %d: %w", cp.Block, err)
+		}
+	}
+
+	log.WithField("block", num).
+		WithField("ancestor", ancestor).
+		WithField("checkpoint", cp.Block).
+		Warn("chain reorganization, roll back output")
+
+	return cp.Block + 1, true, nil
+}
+
+func (c *collectorService) headerByNumber(num *big.Int) (header *types.Header, err error) {
+	err = c.call(fmt.Sprintf("get header %d", num), func(ctx context.Context, e *endpoint) (err error) {
+		header, err = e.cli.HeaderByNumber(ctx, num)
+		return err
+	})
+	return header, err
+}
+
+// nearHead reports whether blocks up to the block can still be reorganized.
+func (c *collectorService) nearHead(block *big.Int) bool {
+	return c.trackReorgs && block.Uint64()+reorgDepth >= c.toBlock.Uint64()
+}
+
+// findAncestor walks back from the header by parent hashes and returns the last block
+// whose known hash is still canonical. Blocks without a known hash are skipped, so
+// ranges recorded only by their end are handled too.
+func (c *collectorService) findAncestor(header *types.Header) (uint64, error) {
+	head := header.Number.Uint64()
+	for num, hash := head-1, header.ParentHash; ; num-- {
+		if known, ok := c.hashes.get(num); ok && known == hash {
+			return num, nil
+		}
+		if num == 0 {
+			return 0, fmt.Errorf("genesis block mismatch")
+		}
+		if head-num >= reorgDepth {
+			return 0, fmt.Errorf("reorganization is deeper than %d blocks", reorgDepth)
+		}
+
+		parent, err := c.headerByNumber(new(big.Int).SetUint64(num))
+		if err != nil {
+			return 0, fmt.Errorf("get header %d: %w", num, err)
+		}
+		hash = parent.ParentHash
+	}
+}
+
+// recordHashes records the hashes of the blocks of the range that can still be
+// reorganized, so a reorganization inside the range finds its ancestor. Hashes of
+// the blocks of the range logs are kept, they are the blocks the output is made of.
+func (c *collectorService) recordHashes(from, to *big.Int) error {
+	first := from.Uint64()
+	if to.Uint64()+1 > first+reorgDepth {
+		first = to.Uint64() + 1 - reorgDepth
+	}
+	for num := first; num <= to.Uint64(); num++ {
+		if _, ok := c.hashes.get(num); ok {
+			continue
+		}
+
+		header, err := c.headerByNumber(new(big.Int).SetUint64(num))
+		if err != nil {
+			return fmt.Errorf("get header %d: %w", num, err)
+		}
+		c.hashes.add(num, header.Hash())
+	}
+	return nil
+}
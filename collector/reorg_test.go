@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFindAncestor(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded []uint64
+		fork     uint64
+		want     uint64
+		wantErr  bool
+	}{
+		{name: "previous block", recorded: []uint64{298, 299}, fork: 300, want: 299},
+		{name: "range ends only", recorded: []uint64{200, 250, 299}, fork: 260, want: 250},
+		{name: "every block", recorded: []uint64{296, 297, 298, 299}, fork: 298, want: 297},
+		{name: "deep", recorded: []uint64{100, 299}, fork: 150, wantErr: true},
+		{name: "nothing recorded", recorded: nil, fork: 290, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBackend(t, 300)
+			c := newTestService(b)
+			for _, num := range tt.recorded {
+				c.hashes.add(num, b.blocks[num].Hash())
+			}
+
+			b.fork(tt.fork)
+			head := b.addBlock(nil)
+
+			got, err := c.findAncestor(head.Header())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("findAncestor() = %d, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findAncestor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReorg(t *testing.T) {
+	b := newFakeBackend(t, 300)
+	c := newTestService(b)
+	msgs := make(chan any)
+	c.msgChan = msgs
+	if err := c.recordHashes(big.NewInt(100), big.NewInt(299)); err != nil {
+		t.Fatal(err)
+	}
+
+	b.fork(295)
+	head := b.addBlock(nil)
+
+	go func() {
+		msg := (<-msgs).(rewindMsg)
+		if msg.block != 294 {
+			t.Errorf("rewind to %d, want 294", msg.block)
+		}
+		msg.reply <- &checkpoint{Block: 290}
+	}()
+
+	next, reorg, err := c.checkReorg(head.Header())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reorg || next != 291 {
+		t.Errorf("checkReorg() = %d, %t, want 291, true", next, reorg)
+	}
+	if _, ok := c.hashes.get(291); ok {
+		t.Error("hash after the checkpoint is kept")
+	}
+}
+
+func TestBlockHashesPrune(t *testing.T) {
+	h := newBlockHashes()
+	h.add(10, common.Hash{1})
+	h.add(500, common.Hash{2})
+	h.add(1000, common.Hash{3})
+
+	if _, ok := h.get(10); ok {
+		t.Error("block 10 is kept")
+	}
+	if _, ok := h.get(500); ok {
+		t.Error("block 500 is kept")
+	}
+	if _, ok := h.get(1000); !ok {
+		t.Error("block 1000 is dropped")
+	}
+
+	h.add(1000+reorgDepth, common.Hash{4})
+	if _, ok := h.get(1000); !ok {
+		t.Error("block within reorgDepth is dropped")
+	}
+}
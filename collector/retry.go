@@ -0,0 +1,175 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/rpc"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultCallTimeout    = time.Minute
+)
+
+type RetryConfig struct {
+	// MaxAttempts is the number of tries of an RPC call including the first one.
+	MaxAttempts    int           `yaml:"MaxAttempts"`
+	InitialBackoff time.Duration `yaml:"InitialBackoff"`
+	MaxBackoff     time.Duration `yaml:"MaxBackoff"`
+	// Timeout bounds a single attempt, a timed out attempt is retried.
+	Timeout time.Duration `yaml:"Timeout"`
+}
+
+func (cfg *RetryConfig) setDefaults() {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = defaultInitialBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultCallTimeout
+	}
+}
+
+// call runs the RPC call fn and repeats it with exponential backoff while it fails
+// with a retryable error. Every attempt waits for the rate limiter and goes to the
+// next endpoint of the pool, so a failed endpoint is replaced by a healthy one.
+// A missing block or tx is asked from the other endpoints first, as the endpoint
+// may lag behind them.
+func (c *collectorService) call(op string, fn func(ctx context.Context, e *endpoint) error) error {
+	return c.callContext(context.Background(), op, fn)
+}
+
+// callContext is call that gives up once the context is done.
+func (c *collectorService) callContext(ctx context.Context, op string, fn func(ctx context.Context, e *endpoint) error) error {
+	var (
+		err      error
+		notFound map[*endpoint]struct{}
+	)
+	for attempt := 1; ; {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("wait rate limiter: %w", err)
+		}
+
+		e := c.pool.next(notFound)
+		attemptCtx, cancel := context.WithTimeout(ctx, c.retry.Timeout)
+		err = fn(attemptCtx, e)
+		cancel()
+		if err == nil {
+			log.WithField("endpoint", e.name).WithField("op", op).Debug("rpc call served")
+			return nil
+		}
+
+		if errors.Is(err, ethereum.NotFound) {
+			if notFound == nil {
+				notFound = make(map[*endpoint]struct{})
+			}
+			notFound[e] = struct{}{}
+			if !c.pool.hasOther(notFound) {
+				return err
+			}
+			log.WithField("endpoint", e.name).WithField("op", op).Debug("not found, ask another endpoint")
+			continue
+		}
+
+		retryable := ctx.Err() == nil && isRetryable(err)
+		if retryable {
+			c.pool.markFailed(e)
+		}
+		if attempt >= c.retry.MaxAttempts || !retryable {
+			return err
+		}
+
+		delay := c.backoff(attempt)
+		log.WithError(err).
+			WithField("endpoint", e.name).
+			WithField("op", op).
+			WithField("attempt", attempt).
+			WithField("delay", delay).
+			Warn("rpc call failed, retry")
+
+		select {
+		case <-c.quit:
+			return fmt.Errorf("stopped while retrying: %w", err)
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled while retrying: %w", err)
+		case <-time.After(delay):
+		}
+		attempt++
+	}
+}
+
+// backoff returns the delay before the next attempt, a random value between
+// half and full of the exponentially growing backoff.
+func (c *collectorService) backoff(attempt int) time.Duration {
+	delay := c.retry.MaxBackoff
+	if attempt < 32 {
+		if d := c.retry.InitialBackoff << (attempt - 1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func isRetryable(err error) bool {
+	// the same query fails again, the caller shrinks the range instead
+	if errors.Is(err, context.Canceled) || isRangeTooLarge(err) {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"too many requests",
+		"rate limit",
+		"timeout",
+		"timed out",
+		"connection reset",
+		"broken pipe",
+		"service unavailable",
+		"bad gateway",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,40 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCallTimeout(t *testing.T) {
+	b := newFakeBackend(t, 10)
+	b.hold = make(chan struct{})
+	c := newTestService(b)
+	c.retry = RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Timeout: 20 * time.Millisecond}
+
+	_, err := c.blockByNumber(context.Background(), big.NewInt(1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("blockByNumber() error = %v, want deadline exceeded", err)
+	}
+	if calls := b.calledMethods["BlockByNumber"]; calls != 3 {
+		t.Errorf("%d attempts, want 3", calls)
+	}
+}
+
+func TestCallCancelled(t *testing.T) {
+	b := newFakeBackend(t, 10)
+	b.hold = make(chan struct{})
+	c := newTestService(b)
+	c.retry = RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Timeout: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.blockByNumber(ctx, big.NewInt(1)); err == nil {
+		t.Fatal("blockByNumber() succeeded after cancel")
+	}
+	if calls := b.calledMethods["BlockByNumber"]; calls != 1 {
+		t.Errorf("%d attempts, want 1", calls)
+	}
+}
@@ -0,0 +1,576 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// RotationConfig splits the output into parts. A part is closed at the first
+// checkpoint where any of the set limits is reached, so the rows of a block are
+// never split between parts. The block and day limits are also checked on the
+// block of each row, as a checkpoint may be far behind the limit.
+type RotationConfig struct {
+	// Blocks is the number of blocks spanned by a part.
+	Blocks uint64 `yaml:"Blocks"`
+	// Rows is the number of rows of a part.
+	Rows int64 `yaml:"Rows"`
+	// MegaBytes is the size of a part.
+	MegaBytes int64 `yaml:"MegaBytes"`
+	// Daily closes the part before the first row of a new UTC day by the block
+	// timestamp. A daily part starts at the block of its first row.
+	Daily bool `yaml:"Daily"`
+	// FileName is the template of the part names relative to the directory of the output
+	// file, {from} and {to} are replaced by the block range of the part. By default it is
+	// the output file name with "_{from}_{to}" before the extension.
+	FileName string `yaml:"FileName"`
+}
+
+func (r RotationConfig) enabled() bool {
+	return r.Blocks > 0 || r.Rows > 0 || r.MegaBytes > 0 || r.Daily
+}
+
+// partialName replaces {to} in the name of the part being written.
+const partialName = "partial"
+
+// rotationManifest lists the parts of a rotated output in block order.
+type rotationManifest struct {
+	Parts []outputPart `json:"Parts"`
+}
+
+type outputPart struct {
+	// File is relative to the directory of the manifest.
+	File      string `json:"File"`
+	FromBlock uint64 `json:"FromBlock"`
+	ToBlock   uint64 `json:"ToBlock"`
+	Rows      int64  `json:"Rows"`
+	Size      int64  `json:"Size"`
+	// Complete parts reached a rotation limit, the last part is appended on resume otherwise.
+	Complete bool `json:"Complete,omitempty"`
+}
+
+// rotatingSink writes csv or JSON Lines rows to a sequence of files. Checkpoint sizes
+// are the sum of the sizes of the parts, so a checkpoint points into a single part.
+type rotatingSink struct {
+	rotation     RotationConfig
+	format       string
+	dir          string
+	template     string
+	manifestPath string
+	blockTime    func(block uint64) (uint64, error)
+	// blockField is the index of the block_number field of the row, -1 if the limits
+	// are only checked at checkpoints.
+	blockField int
+
+	manifest rotationManifest
+	// part is the sink of the last part, nil until a row is written after a rotation.
+	part    sink
+	rows    int64
+	partDay int64
+	// dayBlock is the last block whose day is looked up.
+	dayBlock uint64
+	day      int64
+
+	lastBlock uint64
+	hasBlock  bool
+}
+
+func newRotatingSink(cfg *OutputConfig) (*rotatingSink, error) {
+	s := rotatingSink{
+		rotation:     cfg.Rotation,
+		format:       cfg.Format,
+		dir:          filepath.Dir(cfg.FilePath),
+		template:     cfg.Rotation.FileName,
+		manifestPath: manifestPath(cfg.FilePath),
+		blockTime:    cfg.BlockTime,
+		blockField:   -1,
+		partDay:      -1,
+		day:          -1,
+	}
+	if s.template == "" {
+		base := filepath.Base(cfg.FilePath)
+		ext := filepath.Ext(base)
+		s.template = strings.TrimSuffix(base, ext) + "_{from}_{to}" + ext
+	}
+	if !strings.Contains(s.template, "{from}") {
+		return nil, fmt.Errorf("file name template %q has no {from}", s.template)
+	}
+	if s.rotation.Daily && s.blockTime == nil {
+		return nil, fmt.Errorf("daily rotation needs block timestamps")
+	}
+	if s.rotation.Blocks > 0 || s.rotation.Daily {
+		rowType := reflect.TypeOf(cfg.OutType)
+		if rowType == nil {
+			rowType = reflect.TypeOf(cfg.InType)
+		}
+		if rowType.Kind() == reflect.Pointer {
+			rowType = rowType.Elem()
+		}
+		for _, f := range rowFields(rowType) {
+			if f.name == "block_number" {
+				s.blockField = f.index
+			}
+		}
+		if s.blockField < 0 {
+			return nil, fmt.Errorf("row of type %s has no block_number column", rowType)
+		}
+	}
+
+	var err error
+	if s.manifest, err = loadManifest(s.manifestPath); err != nil {
+		return nil, fmt.Errorf("load manifest: %w", err)
+	}
+
+	// parts of an earlier run are removed unless it is resumed
+	var offset int64
+	if cfg.Append {
+		offset = cfg.Offset
+	}
+	if err := s.restore(offset); err != nil {
+		return nil, err
+	}
+	if err := s.saveManifest(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func manifestPath(filePath string) string {
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".manifest.json"
+}
+
+func loadManifest(path string) (rotationManifest, error) {
+	var m rotationManifest
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return m, fmt.Errorf("read file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("unmarshal json: %w", err)
+	}
+	return m, nil
+}
+
+func (s *rotatingSink) saveManifest() error {
+	data, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal json: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a broken manifest
+	tmpPath := s.manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write file %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.manifestPath); err != nil {
+		return fmt.Errorf("rename %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+// rotatedSize returns the size of the rotated output by the files of its parts.
+func rotatedSize(filePath string) (int64, error) {
+	m, err := loadManifest(manifestPath(filePath))
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	dir := filepath.Dir(filePath)
+	for _, p := range m.Parts {
+		stat, err := os.Stat(filepath.Join(dir, p.File))
+		if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+func (s *rotatingSink) partName(from uint64, to string) string {
+	name := strings.ReplaceAll(s.template, "{from}", strconv.FormatUint(from, 10))
+	return strings.ReplaceAll(name, "{to}", to)
+}
+
+func (s *rotatingSink) current() *outputPart {
+	return &s.manifest.Parts[len(s.manifest.Parts)-1]
+}
+
+func (s *rotatingSink) write(row any) error {
+	var (
+		block uint64
+		split bool
+	)
+	if s.blockField >= 0 {
+		v := reflect.ValueOf(row)
+		if v.Kind() == reflect.Pointer {
+			v = v.Elem()
+		}
+		block = v.Field(s.blockField).Uint()
+
+		if s.part != nil {
+			var err error
+			if split, err = s.splitBefore(block); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.part == nil {
+		var from uint64
+		if s.hasBlock {
+			from = s.lastBlock + 1
+		}
+		if split || s.rotation.Daily {
+			from = block
+		}
+		if err := s.openPart(from); err != nil {
+			return err
+		}
+	}
+
+	if err := s.part.write(row); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+// splitBefore closes the part before a row of the block beyond the block or day
+// limit of the part. The rows of the block are the first ones of the next part.
+func (s *rotatingSink) splitBefore(block uint64) (bool, error) {
+	p := s.current()
+	r := s.rotation
+	if r.Blocks > 0 && block >= p.FromBlock+r.Blocks {
+		return true, s.closeAt(p.FromBlock + r.Blocks - 1)
+	}
+
+	if r.Daily {
+		day, err := s.blockDay(block)
+		if err != nil {
+			return false, err
+		}
+		partDay, err := s.currentDay()
+		if err != nil {
+			return false, err
+		}
+		if day != partDay {
+			return true, s.closeAt(block - 1)
+		}
+	}
+
+	return false, nil
+}
+
+// closeAt completes the part at the block without a checkpoint. The rows written
+// after the last checkpoint stay in the part, a rewind reopens it.
+func (s *rotatingSink) closeAt(block uint64) error {
+	size, err := s.part.checkpoint(block)
+	if err != nil {
+		return err
+	}
+	p := s.current()
+	p.ToBlock, p.Size, p.Rows = block, size, s.rows
+
+	if err := s.closePart(); err != nil {
+		return err
+	}
+	p.Complete = true
+	return s.saveManifest()
+}
+
+func (s *rotatingSink) openPart(from uint64) error {
+	name := s.partName(from, partialName)
+
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file %s: %w", path, err)
+	}
+
+	s.part = newFileSink(s.format, &outputFile{file: file, writer: bufio.NewWriter(file)}, true)
+	s.rows = 0
+	s.partDay = -1
+	s.manifest.Parts = append(s.manifest.Parts, outputPart{File: name, FromBlock: from, ToBlock: from})
+	return nil
+}
+
+func (s *rotatingSink) flush() error {
+	if s.part == nil {
+		return nil
+	}
+	return s.part.flush()
+}
+
+func (s *rotatingSink) checkpoint(block uint64) (int64, error) {
+	s.lastBlock, s.hasBlock = block, true
+	if s.part == nil {
+		return s.size(), nil
+	}
+
+	size, err := s.part.checkpoint(block)
+	if err != nil {
+		return 0, err
+	}
+	p := s.current()
+	p.ToBlock, p.Size, p.Rows = block, size, s.rows
+
+	rotate, err := s.limitReached(p, block)
+	if err != nil {
+		return 0, err
+	}
+	if rotate {
+		// rows past the block limit are split into the next part on write
+		if r := s.rotation; r.Blocks > 0 && p.ToBlock >= p.FromBlock+r.Blocks {
+			p.ToBlock = p.FromBlock + r.Blocks - 1
+		}
+		if err := s.closePart(); err != nil {
+			return 0, err
+		}
+		p.Complete = true
+	}
+
+	if err := s.saveManifest(); err != nil {
+		return 0, err
+	}
+	return s.size(), nil
+}
+
+func (s *rotatingSink) limitReached(p *outputPart, block uint64) (bool, error) {
+	r := s.rotation
+	if r.Blocks > 0 && block+1-p.FromBlock >= r.Blocks ||
+		r.Rows > 0 && p.Rows >= r.Rows ||
+		r.MegaBytes > 0 && p.Size >= r.MegaBytes<<20 {
+		return true, nil
+	}
+
+	if r.Daily {
+		day, err := s.blockDay(block)
+		if err != nil {
+			return false, err
+		}
+		partDay, err := s.currentDay()
+		if err != nil {
+			return false, err
+		}
+		return day != partDay, nil
+	}
+
+	return false, nil
+}
+
+// currentDay returns the UTC day of the first block of the last part.
+func (s *rotatingSink) currentDay() (int64, error) {
+	if s.partDay < 0 {
+		day, err := s.blockDay(s.current().FromBlock)
+		if err != nil {
+			return 0, err
+		}
+		s.partDay = day
+	}
+	return s.partDay, nil
+}
+
+// blockDay returns the UTC day of the block by its timestamp.
+func (s *rotatingSink) blockDay(block uint64) (int64, error) {
+	if s.day >= 0 && s.dayBlock == block {
+		return s.day, nil
+	}
+
+	t, err := s.blockTime(block)
+	if err != nil {
+		return 0, fmt.Errorf("get time of block %d: %w", block, err)
+	}
+	s.dayBlock, s.day = block, int64(t/(24*60*60))
+	return s.day, nil
+}
+
+// closePart closes the last part and names it by its block range.
+func (s *rotatingSink) closePart() error {
+	err := s.part.close()
+	s.part = nil
+	if err != nil {
+		return err
+	}
+
+	p := s.current()
+	name := s.partName(p.FromBlock, strconv.FormatUint(p.ToBlock, 10))
+	if err := os.Rename(filepath.Join(s.dir, p.File), filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("rename part: %w", err)
+	}
+	p.File = name
+	return nil
+}
+
+func (s *rotatingSink) size() int64 {
+	var size int64
+	for _, p := range s.manifest.Parts {
+		size += p.Size
+	}
+	return size
+}
+
+func (s *rotatingSink) rewind(cp checkpoint) error {
+	if s.part != nil {
+		err := s.part.close()
+		s.part = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.restore(cp.Size); err != nil {
+		return err
+	}
+	if s.part != nil {
+		s.current().ToBlock = cp.Block
+	}
+	s.lastBlock, s.hasBlock = cp.Block, true
+
+	return s.saveManifest()
+}
+
+// restore drops the parts after the size and reopens the part holding it.
+func (s *rotatingSink) restore(size int64) error {
+	if total := s.size(); size > total {
+		return fmt.Errorf("checkpoint size %d is beyond the parts of %d bytes", size, total)
+	}
+
+	var start int64
+	keep := 0
+	for i := range s.manifest.Parts {
+		p := &s.manifest.Parts[i]
+		end := start + p.Size
+		if size > end || size == end && p.Complete {
+			keep, start = i+1, end
+			continue
+		}
+		if size > start {
+			if err := s.reopenPart(p, size-start); err != nil {
+				return err
+			}
+			keep = i + 1
+		}
+		break
+	}
+
+	for _, p := range s.manifest.Parts[keep:] {
+		if err := os.Remove(filepath.Join(s.dir, p.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove part: %w", err)
+		}
+	}
+	s.manifest.Parts = s.manifest.Parts[:keep]
+	return nil
+}
+
+func (s *rotatingSink) reopenPart(p *outputPart, offset int64) error {
+	name := s.partName(p.FromBlock, partialName)
+	if p.File != name {
+		if err := os.Rename(filepath.Join(s.dir, p.File), filepath.Join(s.dir, name)); err != nil {
+			return fmt.Errorf("rename part: %w", err)
+		}
+		p.File = name
+	}
+
+	path := filepath.Join(s.dir, name)
+	rows, err := countRows(path, s.format, offset)
+	if err != nil {
+		return fmt.Errorf("count rows of %s: %w", path, err)
+	}
+	file, err := openForAppend(path, offset)
+	if err != nil {
+		return fmt.Errorf("open file %s: %w", path, err)
+	}
+
+	s.part = newFileSink(s.format, &outputFile{file: file, writer: bufio.NewWriter(file)}, false)
+	s.rows = rows
+	s.partDay = -1
+	p.Size, p.Rows, p.Complete = offset, rows, false
+	return nil
+}
+
+// countRows counts the rows in the first size bytes of the file.
+func countRows(path, format string, size int64) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := io.LimitReader(file, size)
+
+	if format == OutputFormatJSONL {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return int64(bytes.Count(data, []byte{'\n'})), nil
+	}
+
+	// the header is not a row
+	var rows int64 = -1
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for {
+		if _, err := reader.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return 0, err
+		}
+		rows++
+	}
+	if rows < 0 {
+		rows = 0
+	}
+	return rows, nil
+}
+
+// close names the last part by the block range up to the last checkpoint, rows after
+// it are dropped on resume.
+func (s *rotatingSink) close() error {
+	if s.part == nil {
+		return nil
+	}
+
+	size, err := s.part.checkpoint(s.lastBlock)
+	if err != nil {
+		return err
+	}
+	p := s.current()
+	p.Size, p.Rows = size, s.rows
+	if s.hasBlock && s.lastBlock >= p.FromBlock {
+		p.ToBlock = s.lastBlock
+	}
+
+	if err := s.closePart(); err != nil {
+		return err
+	}
+	return s.saveManifest()
+}
+
+func (c *collectorService) blockTime(block uint64) (uint64, error) {
+	header, err := c.headerByNumber(new(big.Int).SetUint64(block))
+	if err != nil {
+		return 0, err
+	}
+	return header.Time, nil
+}
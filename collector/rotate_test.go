@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// sixHourBlocks makes four blocks a day.
+func sixHourBlocks(block uint64) (uint64, error) {
+	return block * 6 * 60 * 60, nil
+}
+
+type rotatedPart struct {
+	file     string
+	from, to uint64
+	blocks   []uint64
+	complete bool
+}
+
+// readParts returns the parts of the rotated output with the blocks of their rows.
+func readParts(t *testing.T, filePath, format string) []rotatedPart {
+	t.Helper()
+
+	m, err := loadManifest(manifestPath(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []rotatedPart
+	for _, p := range m.Parts {
+		var rows []testRow
+		if err := readRows(filepath.Join(filepath.Dir(filePath), p.File), format, &rows); err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(rows)) != p.Rows {
+			t.Errorf("part %s has %d rows, manifest says %d", p.File, len(rows), p.Rows)
+		}
+
+		part := rotatedPart{file: p.File, from: p.FromBlock, to: p.ToBlock, complete: p.Complete}
+		for _, r := range rows {
+			part.blocks = append(part.blocks, r.BlockNumber)
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func blockRows(blocks ...uint64) []any {
+	var rows []any
+	for _, b := range blocks {
+		rows = append(rows, testRow{BlockNumber: b, TxHash: "0x01"})
+	}
+	return rows
+}
+
+func TestRotatingOutput(t *testing.T) {
+	steps := func(parts ...[]any) []any {
+		var all []any
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name     string
+		rotation RotationConfig
+		steps    []any
+		want     []rotatedPart
+	}{
+		{
+			name:     "blocks split within a checkpoint range",
+			rotation: RotationConfig{Blocks: 3},
+			steps:    steps([]any{checkpointMsg(0)}, blockRows(1, 2, 3, 4, 6, 7, 11), []any{checkpointMsg(11)}),
+			want: []rotatedPart{
+				{file: "out_1_3.csv", from: 1, to: 3, blocks: []uint64{1, 2, 3}, complete: true},
+				{file: "out_4_6.csv", from: 4, to: 6, blocks: []uint64{4, 6}, complete: true},
+				{file: "out_7_9.csv", from: 7, to: 9, blocks: []uint64{7}, complete: true},
+				{file: "out_11_11.csv", from: 11, to: 11, blocks: []uint64{11}},
+			},
+		},
+		{
+			name:     "blocks at checkpoints",
+			rotation: RotationConfig{Blocks: 3},
+			steps: steps([]any{checkpointMsg(0)}, blockRows(1), []any{checkpointMsg(2)},
+				blockRows(3), []any{checkpointMsg(5)}, blockRows(6), []any{checkpointMsg(6)}),
+			want: []rotatedPart{
+				{file: "out_1_3.csv", from: 1, to: 3, blocks: []uint64{1, 3}, complete: true},
+				{file: "out_6_6.csv", from: 6, to: 6, blocks: []uint64{6}},
+			},
+		},
+		{
+			name:     "daily split within a checkpoint range",
+			rotation: RotationConfig{Daily: true},
+			steps:    steps([]any{checkpointMsg(0)}, blockRows(1, 2, 2, 5, 6, 9), []any{checkpointMsg(9)}),
+			want: []rotatedPart{
+				{file: "out_1_4.csv", from: 1, to: 4, blocks: []uint64{1, 2, 2}, complete: true},
+				{file: "out_5_8.csv", from: 5, to: 8, blocks: []uint64{5, 6}, complete: true},
+				{file: "out_9_9.csv", from: 9, to: 9, blocks: []uint64{9}},
+			},
+		},
+		{
+			name:     "daily at checkpoints",
+			rotation: RotationConfig{Daily: true},
+			steps:    steps(blockRows(1), []any{checkpointMsg(3)}, blockRows(3), []any{checkpointMsg(4)}, blockRows(5), []any{checkpointMsg(5)}),
+			want: []rotatedPart{
+				{file: "out_1_4.csv", from: 1, to: 4, blocks: []uint64{1, 3}, complete: true},
+				{file: "out_5_5.csv", from: 5, to: 5, blocks: []uint64{5}},
+			},
+		},
+		{
+			name:     "rewind into a split part",
+			rotation: RotationConfig{Blocks: 3},
+			steps: steps([]any{checkpointMsg(0)}, blockRows(1, 2), []any{checkpointMsg(2)}, blockRows(3, 4, 5),
+				[]any{rewindTo(2)}, blockRows(3, 4), []any{checkpointMsg(4)}),
+			want: []rotatedPart{
+				{file: "out_1_3.csv", from: 1, to: 3, blocks: []uint64{1, 2, 3}, complete: true},
+				{file: "out_4_4.csv", from: 4, to: 4, blocks: []uint64{4}},
+			},
+		},
+		{
+			name:     "rows",
+			rotation: RotationConfig{Rows: 2},
+			steps:    steps([]any{checkpointMsg(0)}, blockRows(1, 1, 1), []any{checkpointMsg(1)}, blockRows(2), []any{checkpointMsg(3)}),
+			want: []rotatedPart{
+				{file: "out_1_1.csv", from: 1, to: 1, blocks: []uint64{1, 1, 1}, complete: true},
+				{file: "out_2_3.csv", from: 2, to: 3, blocks: []uint64{2}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.csv")
+			runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatCSV, Rotation: tt.rotation, BlockTime: sixHourBlocks}, tt.steps...)
+
+			if got := readParts(t, path, OutputFormatCSV); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotatingOutputResume(t *testing.T) {
+	for _, format := range []string{OutputFormatCSV, OutputFormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out."+format)
+			cfg := OutputConfig{FilePath: path, Format: format, Rotation: RotationConfig{Blocks: 3}}
+
+			var steps []any
+			steps = append(steps, checkpointMsg(0))
+			steps = append(steps, blockRows(1, 2)...)
+			steps = append(steps, checkpointMsg(2))
+			steps = append(steps, blockRows(3, 4)...)
+			checkpoints := runOutput(t, cfg, steps...)
+			cp := checkpoints[len(checkpoints)-1]
+
+			// the rows written after the checkpoint are dropped, including the split part
+			cfg.Append, cfg.Offset = true, cp.Size
+			steps = append(blockRows(3, 4, 7), checkpointMsg(7))
+			runOutput(t, cfg, steps...)
+
+			want := []rotatedPart{
+				{file: "out_1_3." + format, from: 1, to: 3, blocks: []uint64{1, 2, 3}, complete: true},
+				{file: "out_4_6." + format, from: 4, to: 6, blocks: []uint64{4}, complete: true},
+				{file: "out_7_7." + format, from: 7, to: 7, blocks: []uint64{7}},
+			}
+			if got := readParts(t, path, format); !reflect.DeepEqual(got, want) {
+				t.Errorf("parts = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRotatingOutputNeedsBlockNumber(t *testing.T) {
+	type row struct {
+		TxHash string `csv:"tx_hash"`
+	}
+
+	path := filepath.Join(t.TempDir(), "out.csv")
+	if _, err := newRotatingSink(&OutputConfig{FilePath: path, Format: OutputFormatCSV, InType: row{}, Rotation: RotationConfig{Blocks: 10}}); err == nil {
+		t.Error("block rotation of rows without blocks")
+	}
+	s, err := newRotatingSink(&OutputConfig{FilePath: path, Format: OutputFormatCSV, InType: row{}, Rotation: RotationConfig{Rows: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,35 @@
+// Package simulated adapts the go-ethereum simulated backend to the collector.
+package simulated
+
+import (
+	"context"
+	"math/big"
+
+	"collector/collector"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var _ collector.Backend = Backend{}
+
+// Backend adds the methods the simulated backend lacks.
+type Backend struct {
+	*backends.SimulatedBackend
+}
+
+func (b Backend) BlockNumber(ctx context.Context) (uint64, error) {
+	return b.Blockchain().CurrentBlock().Number.Uint64(), nil
+}
+
+func (b Backend) ChainID(ctx context.Context) (*big.Int, error) {
+	return b.Blockchain().Config().ChainID, nil
+}
+
+func (b Backend) BlockReceipts(ctx context.Context, number *big.Int) ([]*types.Receipt, error) {
+	block, err := b.BlockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return b.Blockchain().GetReceiptsByHash(block.Hash()), nil
+}
@@ -0,0 +1,99 @@
+package simulated_test
+
+import (
+	"context"
+	"encoding/csv"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"collector/collector"
+	"collector/collector/simulated"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestRunWithSimulatedBackend(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	receiver := common.HexToAddress("0xbeef")
+
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{sender: {Balance: big.NewInt(1e18)}}, 10_000_000)
+	defer sim.Close()
+	backend := simulated.Backend{SimulatedBackend: sim}
+
+	ctx := context.Background()
+	chainID, err := backend.ChainID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gasPrice, err := sim.SuggestGasPrice(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []common.Hash
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		tx, err := types.SignNewTx(key, types.LatestSignerForChainID(chainID), &types.LegacyTx{
+			Nonce:    nonce,
+			To:       &receiver,
+			Value:    big.NewInt(1000),
+			Gas:      21000,
+			GasPrice: gasPrice,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sim.SendTransaction(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+		sim.Commit()
+		hashes = append(hashes, tx.Hash())
+	}
+
+	dir := t.TempDir()
+	cfg := collector.Config{
+		Address:        receiver.Hex(),
+		ToBlock:        -1,
+		OutputFilePath: filepath.Join(dir, "txs.csv"),
+		DataDir:        filepath.Join(dir, "data"),
+	}
+	if err := collector.RunWithBackend(ctx, cfg, backend); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(cfg.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(hashes)+1 {
+		t.Fatalf("got %d rows, want %d", len(records)-1, len(hashes))
+	}
+
+	header := make(map[string]int)
+	for i, name := range records[0] {
+		header[name] = i
+	}
+	for i, hash := range hashes {
+		row := records[i+1]
+		if row[header["tx_hash"]] != hash.Hex() {
+			t.Errorf("row %d has tx %s, want %s", i, row[header["tx_hash"]], hash.Hex())
+		}
+		if row[header["status"]] != "1" || row[header["gas_used"]] != "21000" || row[header["value"]] != "1000" {
+			t.Errorf("row %d = %v", i, row)
+		}
+	}
+}
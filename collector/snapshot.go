@@ -0,0 +1,290 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"collector/smartcontract/erc20"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+type SnapshotConfig struct {
+	Address string
+	// Block is the block of the snapshot, Timestamp picks the last block mined at
+	// or before it instead, only one of them can be set. The latest confirmed block
+	// is used if both are negative.
+	Block     int64
+	Timestamp int64
+	// Discover adds tokens transferred to or from the address up to the block to the
+	// known ones. The search starts from FromBlock of the collector config.
+	Discover       bool
+	OutputFilePath string
+}
+
+// PortfolioInfo is a row of the snapshot, a non-zero balance of ETH or a token.
+type PortfolioInfo struct {
+	Address           string `csv:"address"`
+	BlockNumber       uint64 `csv:"block_number"`
+	Token             string `csv:"token"`
+	Symbol            string `csv:"symbol"`
+	Balance           string `csv:"balance"`
+	NormalizedBalance string `csv:"normalized_balance"`
+}
+
+// Snapshot writes balances of ETH and the known tokens held by the address at the block.
+// Tokens are known from the tokens cache of earlier runs or discovered from transfers.
+func Snapshot(cfg Config, snapshotCfg SnapshotConfig) (err error) {
+	pool, err := dialEndpoints(endpointConfigs(cfg), cfg.MaxBlockLag)
+	if err != nil {
+		return fmt.Errorf("dial endpoints: %w", err)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	c := newCollectorService(ctx, cfg)
+	c.pool = pool
+	defer c.stop()
+
+	go c.pool.runHealthChecks(c, cfg.HealthCheckInterval)
+
+	if !common.IsHexAddress(snapshotCfg.Address) {
+		return fmt.Errorf("invalid address %q", snapshotCfg.Address)
+	}
+	address := common.HexToAddress(snapshotCfg.Address)
+
+	// the portfolio format comes from its own path, --format applies to the collector output
+	format, err := outputFormat("", snapshotCfg.OutputFilePath)
+	if err != nil {
+		return err
+	}
+	if format != OutputFormatCSV && format != OutputFormatJSONL {
+		return fmt.Errorf("snapshot can't be written as %s, use a .csv or .jsonl path", format)
+	}
+
+	c.abi, err = erc20.Erc20MetaData.GetAbi()
+	if err != nil {
+		return fmt.Errorf("parse token abi: %w", err)
+	}
+
+	// the tokens cache is shared with the collector, it may live in its SQLite output
+	c.outputFilePath = cfg.OutputFilePath
+	if c.outputFormat, err = outputFormat(cfg.OutputFormat, cfg.OutputFilePath); err != nil {
+		return err
+	}
+	if err := c.initTokensInfo(); err != nil {
+		return fmt.Errorf("init tokens info: %w", err)
+	}
+
+	block, err := c.snapshotBlock(snapshotCfg.Block, snapshotCfg.Timestamp)
+	if err != nil {
+		return fmt.Errorf("get snapshot block: %w", err)
+	}
+
+	log.WithField("address", address.Hex()).WithField("block", block).Info("take snapshot")
+
+	c.mu.RLock()
+	tokens := make([]common.Address, 0, len(c.tokens))
+	for a := range c.tokens {
+		tokens = append(tokens, common.HexToAddress(a))
+	}
+	c.mu.RUnlock()
+
+	if snapshotCfg.Discover {
+		from := big.NewInt(cfg.FromBlock)
+		if from.Sign() < 0 {
+			from = common.Big0
+		}
+		discovered, err := c.discoverTokens(address, from, block)
+		if err != nil {
+			return fmt.Errorf("discover tokens: %w", err)
+		}
+		tokens = append(tokens, discovered...)
+	}
+
+	portfolio, err := c.portfolio(address, block, tokens)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRowsFile(snapshotCfg.OutputFilePath, format, portfolio); err != nil {
+		return fmt.Errorf("write portfolio: %w", err)
+	}
+
+	log.WithField("path", snapshotCfg.OutputFilePath).WithField("assets", len(portfolio)).Info("snapshot written")
+	return nil
+}
+
+func (c *collectorService) portfolio(address common.Address, block *big.Int, tokens []common.Address) ([]PortfolioInfo, error) {
+	var ethBalance *big.Int
+	err := c.call(fmt.Sprintf("get eth balance at %d", block), func(ctx context.Context, e *endpoint) (err error) {
+		ethBalance, err = e.cli.BalanceAt(ctx, address, block)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get eth balance: %w", err)
+	}
+
+	var (
+		result []PortfolioInfo
+		seen   = make(map[common.Address]struct{})
+	)
+	for _, tokenAddress := range tokens {
+		if _, ok := seen[tokenAddress]; ok {
+			continue
+		}
+		seen[tokenAddress] = struct{}{}
+
+		if c.stopped() {
+			return nil, fmt.Errorf("stopped")
+		}
+
+		balance, err := c.balanceOf(balanceKey{token: tokenAddress, holder: address}, block)
+		if err != nil {
+			// the token may not exist at the block yet
+			log.WithError(err).WithField("token", tokenAddress.Hex()).Warn("get token balance")
+			continue
+		}
+		if balance.Sign() == 0 {
+			continue
+		}
+
+		token, err := c.getTokenInfo(tokenAddress.Hex())
+		if err != nil {
+			log.WithError(err).WithField("token", tokenAddress.Hex()).Warn("get token info")
+			continue
+		}
+
+		result = append(result, PortfolioInfo{
+			Address:           address.Hex(),
+			BlockNumber:       block.Uint64(),
+			Token:             token.Address,
+			Symbol:            token.Symbol,
+			Balance:           balance.String(),
+			NormalizedBalance: Normalize(balance, token.Decimals),
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Symbol < result[j].Symbol
+	})
+
+	if ethBalance.Sign() == 0 {
+		return result, nil
+	}
+	eth := PortfolioInfo{
+		Address:           address.Hex(),
+		BlockNumber:       block.Uint64(),
+		Token:             nativeToken.Address,
+		Symbol:            nativeToken.Symbol,
+		Balance:           ethBalance.String(),
+		NormalizedBalance: Normalize(ethBalance, nativeToken.Decimals),
+	}
+	return append([]PortfolioInfo{eth}, result...), nil
+}
+
+// snapshotBlock resolves the block of the snapshot.
+func (c *collectorService) snapshotBlock(block, timestamp int64) (*big.Int, error) {
+	if block >= 0 && timestamp >= 0 {
+		return nil, fmt.Errorf("both block and timestamp are set")
+	}
+	if block >= 0 {
+		return big.NewInt(block), nil
+	}
+
+	var head uint64
+	err := c.call("get last block", func(ctx context.Context, e *endpoint) (err error) {
+		head, err = e.cli.BlockNumber(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get last block: %w", err)
+	}
+	head = c.confirmed(head)
+
+	if timestamp < 0 {
+		return new(big.Int).SetUint64(head), nil
+	}
+	return c.blockByTimestamp(uint64(timestamp), head)
+}
+
+// blockByTimestamp returns the last block mined at or before the timestamp with binary search.
+func (c *collectorService) blockByTimestamp(timestamp, head uint64) (*big.Int, error) {
+	lo, hi := uint64(0), head
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		header, err := c.headerByNumber(new(big.Int).SetUint64(mid))
+		if err != nil {
+			return nil, fmt.Errorf("get header %d: %w", mid, err)
+		}
+
+		if header.Time <= timestamp {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	header, err := c.headerByNumber(new(big.Int).SetUint64(lo))
+	if err != nil {
+		return nil, fmt.Errorf("get header %d: %w", lo, err)
+	}
+	if header.Time > timestamp {
+		return nil, fmt.Errorf("timestamp %d is before the first block", timestamp)
+	}
+
+	return new(big.Int).SetUint64(lo), nil
+}
+
+// discoverTokens returns contracts of ERC-20 transfers to or from the address.
+func (c *collectorService) discoverTokens(address common.Address, from, to *big.Int) ([]common.Address, error) {
+	transferTopic := c.abi.Events["Transfer"].ID
+	queries := []logsQuery{
+		{topics: [][]common.Hash{{transferTopic}, {address.Hash()}}},
+		{topics: [][]common.Hash{{transferTopic}, {}, {address.Hash()}}},
+	}
+
+	var (
+		tokens []common.Address
+		seen   = make(map[common.Address]struct{})
+		q      = ethereum.FilterQuery{ToBlock: new(big.Int).Sub(from, common.Big1)}
+	)
+	updateQuery(&q, c.logsBatch, to)
+
+	for q.FromBlock.Cmp(to) <= 0 {
+		if c.stopped() {
+			return nil, fmt.Errorf("stopped")
+		}
+
+		span := q.ToBlock.Uint64() - q.FromBlock.Uint64() + 1
+		events, err := c.filterLogs(q, queries)
+		if err != nil {
+			if isRangeTooLarge(err) && c.shrinkLogsBatch(span) {
+				q.ToBlock = new(big.Int).Sub(q.FromBlock, common.Big1)
+				updateQuery(&q, c.logsBatch, to)
+				continue
+			}
+			return nil, fmt.Errorf("filter logs from %d to %d: %w", q.FromBlock, q.ToBlock, err)
+		}
+
+		for _, event := range events {
+			if len(event.Topics) != 3 {
+				continue
+			}
+			if _, ok := seen[event.Address]; !ok {
+				seen[event.Address] = struct{}{}
+				tokens = append(tokens, event.Address)
+			}
+		}
+
+		c.growLogsBatch(span, len(events))
+		updateQuery(&q, c.logsBatch, to)
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"collector/smartcontract/erc20"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSnapshotBlock(t *testing.T) {
+	c := newTestService(newFakeBackend(t, 20))
+	c.confirmations = 4
+
+	tests := []struct {
+		name      string
+		block     int64
+		timestamp int64
+		want      uint64
+		wantErr   bool
+	}{
+		{name: "latest confirmed", block: -1, timestamp: -1, want: 15},
+		{name: "block", block: 7, timestamp: -1, want: 7},
+		{name: "timestamp", block: -1, timestamp: 1_700_000_000 + 12*5 + 3, want: 5},
+		{name: "timestamp of a block", block: -1, timestamp: 1_700_000_000 + 12*6, want: 6},
+		{name: "timestamp after head", block: -1, timestamp: 1_800_000_000, want: 15},
+		{name: "timestamp before first block", block: -1, timestamp: 1_600_000_000, wantErr: true},
+		{name: "block and timestamp", block: 7, timestamp: 1_700_000_000, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.snapshotBlock(tt.block, tt.timestamp)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("snapshotBlock() = %d, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Uint64() != tt.want {
+				t.Errorf("snapshotBlock() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortfolio(t *testing.T) {
+	tokenABI, err := erc20.Erc20MetaData.GetAbi()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		holder = common.HexToAddress("0xa")
+		usdc   = common.HexToAddress("0x1")
+		dai    = common.HexToAddress("0x2")
+		empty  = common.HexToAddress("0x3")
+	)
+	tokens := []struct {
+		address  common.Address
+		symbol   string
+		decimals uint8
+		balance  int64
+	}{
+		{usdc, "USDC", 6, 1_500_000},
+		{dai, "DAI", 18, 2},
+		{empty, "NONE", 18, 0},
+	}
+
+	b := newFakeBackend(t, 1)
+	for _, token := range tokens {
+		b.setCall(token.address, tokenABI, "symbol", token.symbol)
+		b.setCall(token.address, tokenABI, "decimals", token.decimals)
+		b.setCall(token.address, tokenABI, "balanceOf", big.NewInt(token.balance))
+	}
+
+	c := newTestService(b)
+	c.tokens = make(map[string]tokenInfo)
+
+	holdings := []PortfolioInfo{
+		{Address: holder.Hex(), Token: dai.Hex(), Symbol: "DAI", Balance: "2", NormalizedBalance: "0.000000000000000002"},
+		{Address: holder.Hex(), Token: usdc.Hex(), Symbol: "USDC", Balance: "1500000", NormalizedBalance: "1.5"},
+	}
+
+	t.Run("without eth", func(t *testing.T) {
+		got, err := c.portfolio(holder, common.Big0, []common.Address{usdc, empty, dai, usdc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, holdings) {
+			t.Errorf("portfolio() = %+v, want %+v", got, holdings)
+		}
+	})
+
+	t.Run("with eth", func(t *testing.T) {
+		b.balances[holder] = big.NewInt(3e17)
+
+		got, err := c.portfolio(holder, common.Big0, []common.Address{usdc, dai})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]PortfolioInfo{{
+			Address:           holder.Hex(),
+			Token:             nativeToken.Address,
+			Symbol:            nativeToken.Symbol,
+			Balance:           "300000000000000000",
+			NormalizedBalance: "0.3",
+		}}, holdings...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("portfolio() = %+v, want %+v", got, want)
+		}
+	})
+}
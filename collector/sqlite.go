@@ -0,0 +1,362 @@
+package collector
+
+import (
+	"database/sql"
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const OutputFormatSQLite = "sqlite"
+
+// jobColumn holds the job of a row in a database output, so jobs sharing the
+// database don't upsert or delete the rows of each other.
+const jobColumn = "job"
+
+// dbTable is the table of a row type in a database output and the columns of its primary key.
+type dbTable struct {
+	name string
+	key  []string
+}
+
+// dbTables maps row types to tables, rows of other types go to the events table.
+// Native and internal transfers have no log, so the kind and the trace path tell
+// them apart from the token transfer with the same event id.
+var dbTables = map[reflect.Type]dbTable{
+	reflect.TypeOf(TransactionInfo{}): {name: "transactions", key: []string{"tx_hash"}},
+	reflect.TypeOf(TransferInfo{}):    {name: "transfers", key: []string{"tx_hash", "event_id", "kind", "trace_path"}},
+	reflect.TypeOf(NFTTransferInfo{}): {name: "nft_transfers", key: []string{"tx_hash", "event_id", "batch_index"}},
+}
+
+// sqliteSink upserts rows into a table of a SQLite database, so rows of blocks
+// collected again replace the earlier ones. Rows are committed at checkpoints and
+// a reorganization deletes the rows of the job after the block of the checkpoint.
+type sqliteSink struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	job     string
+	table   dbTable
+	rowType reflect.Type
+	fields  []rowField
+	insert  string
+}
+
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newSqliteSink(cfg *OutputConfig) (*sqliteSink, error) {
+	rowType := reflect.TypeOf(cfg.OutType)
+	if rowType == nil {
+		rowType = reflect.TypeOf(cfg.InType)
+	}
+	if rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+
+	s := sqliteSink{job: cfg.Job, rowType: rowType, fields: rowFields(rowType)}
+	table, err := tableOf(rowType)
+	if err != nil {
+		return nil, err
+	}
+	s.table = table
+
+	columns := []string{jobColumn}
+	definitions := []string{fmt.Sprintf("%q TEXT NOT NULL", jobColumn)}
+	for _, f := range s.fields {
+		columns = append(columns, f.name)
+		definitions = append(definitions, fmt.Sprintf("%q %s NOT NULL", f.name, sqliteType(rowType.Field(f.index).Type)))
+	}
+
+	s.insert = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s",
+		table.name, quoteColumns(columns), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "),
+		upsertClause(table, columns))
+
+	db, err := openSqlite(cfg.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %w", cfg.FilePath, err)
+	}
+	s.db = db
+
+	existing, err := sqliteColumns(db, table.name)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read columns of table %s: %w", table.name, err)
+	}
+	if err := checkColumns(table.name, existing, columns); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, PRIMARY KEY (%s))",
+		table.name, strings.Join(definitions, ", "), quoteColumns(table.key))
+	if _, err := db.Exec(create); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create table %s: %w", table.name, err)
+	}
+	index := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_block_number ON %s (%q, block_number)", table.name, table.name, jobColumn)
+	if _, err := db.Exec(index); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create index: %w", err)
+	}
+
+	return &s, nil
+}
+
+// tableOf returns the table of the row type, the key starts with the job column.
+func tableOf(rowType reflect.Type) (dbTable, error) {
+	table, ok := dbTables[rowType]
+	if !ok {
+		table = dbTable{name: "events", key: []string{"tx_hash", "event_id"}}
+	}
+
+	fields := rowFields(rowType)
+	for _, k := range table.key {
+		found := false
+		for _, f := range fields {
+			found = found || f.name == k
+		}
+		if !found {
+			return table, fmt.Errorf("row of type %s has no %s column", rowType, k)
+		}
+	}
+	for _, f := range fields {
+		if f.name == jobColumn {
+			return table, fmt.Errorf("row of type %s has the reserved %s column", rowType, jobColumn)
+		}
+	}
+
+	table.key = append([]string{jobColumn}, table.key...)
+	return table, nil
+}
+
+// sqliteColumns returns the columns of the table, none if it doesn't exist.
+func sqliteColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// checkColumns fails if the table already exists with other columns than the rows,
+// e.g. the events table after the events of the config changed.
+func checkColumns(table string, existing, columns []string) error {
+	if len(existing) == 0 {
+		return nil
+	}
+
+	have, want := append([]string(nil), existing...), append([]string(nil), columns...)
+	sort.Strings(have)
+	sort.Strings(want)
+	if !reflect.DeepEqual(have, want) {
+		return fmt.Errorf("table %s has columns %s but rows have %s, use another database or drop the table",
+			table, strings.Join(existing, ", "), strings.Join(columns, ", "))
+	}
+	return nil
+}
+
+// upsertClause replaces the columns of an existing row with the same key, both
+// SQLite and PostgreSQL support the syntax.
+func upsertClause(table dbTable, columns []string) string {
+	var updates []string
+	for _, column := range columns {
+		if !containsString(table.key, column) {
+			updates = append(updates, fmt.Sprintf("%q = excluded.%q", column, column))
+		}
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", quoteColumns(table.key), strings.Join(updates, ", "))
+}
+
+// rowValues returns the values of the columns of the row, TextMarshaler fields are
+// written as text.
+func rowValues(row reflect.Value, fields []rowField) ([]any, error) {
+	values := make([]any, len(fields))
+	for i, f := range fields {
+		value := row.Field(f.index).Interface()
+		if m, ok := value.(encoding.TextMarshaler); ok {
+			text, err := m.MarshalText()
+			if err != nil {
+				return nil, fmt.Errorf("marshal %s: %w", f.name, err)
+			}
+			value = string(text)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func sqliteType(t reflect.Type) string {
+	if t.Implements(textMarshalerType) {
+		return "TEXT"
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	default:
+		return "TEXT"
+	}
+}
+
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = fmt.Sprintf("%q", c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func (s *sqliteSink) write(row any) error {
+	v := reflect.ValueOf(row)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Type() != s.rowType {
+		return fmt.Errorf("row of type %s doesn't match table of %s", v.Type(), s.rowType)
+	}
+
+	values, err := rowValues(v, s.fields)
+	if err != nil {
+		return err
+	}
+
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin: %w", err)
+		}
+		s.tx = tx
+	}
+	_, err = s.tx.Exec(s.insert, append([]any{s.job}, values...)...)
+	return err
+}
+
+// flush is a no-op, rows are committed at checkpoints.
+func (s *sqliteSink) flush() error {
+	return nil
+}
+
+// checkpoint commits the rows. The size is always zero as the database is never
+// truncated on resume, rows collected again are upserted.
+func (s *sqliteSink) checkpoint(uint64) (int64, error) {
+	return 0, s.commit()
+}
+
+func (s *sqliteSink) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteSink) rewind(cp checkpoint) error {
+	if s.tx != nil {
+		tx := s.tx
+		s.tx = nil
+		if err := tx.Rollback(); err != nil {
+			return fmt.Errorf("rollback: %w", err)
+		}
+	}
+
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %q = ? AND block_number > ?", s.table.name, jobColumn), s.job, cp.Block)
+	return err
+}
+
+func (s *sqliteSink) close() error {
+	if err := s.commit(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+const createTokensTable = `CREATE TABLE IF NOT EXISTS tokens (
+	address TEXT PRIMARY KEY,
+	symbol TEXT NOT NULL,
+	decimals INTEGER NOT NULL
+)`
+
+// loadSqliteTokens reads the tokens cache kept in the output database.
+func loadSqliteTokens(path string) ([]tokenInfo, error) {
+	db, err := openSqlite(path)
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %w", path, err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(createTokensTable); err != nil {
+		return nil, fmt.Errorf("create table tokens: %w", err)
+	}
+
+	rows, err := db.Query("SELECT address, symbol, decimals FROM tokens")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []tokenInfo
+	for rows.Next() {
+		var i tokenInfo
+		if err := rows.Scan(&i.Address, &i.Symbol, &i.Decimals); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, i)
+	}
+	return tokens, rows.Err()
+}
+
+func saveSqliteTokens(path string, tokens []tokenInfo) error {
+	db, err := openSqlite(path)
+	if err != nil {
+		return fmt.Errorf("open database %s: %w", path, err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(createTokensTable); err != nil {
+		return fmt.Errorf("create table tokens: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, i := range tokens {
+		_, err := tx.Exec(`INSERT INTO tokens (address, symbol, decimals) VALUES (?, ?, ?)
+			ON CONFLICT (address) DO UPDATE SET symbol = excluded.symbol, decimals = excluded.decimals`,
+			i.Address, i.Symbol, i.Decimals)
+		if err != nil {
+			return fmt.Errorf("upsert token %s: %w", i.Address, err)
+		}
+	}
+	return tx.Commit()
+}
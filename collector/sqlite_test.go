@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readSqliteRows(t *testing.T, path, job string) []testRow {
+	t.Helper()
+
+	db, err := openSqlite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT block_number, tx_hash, event_id, failed FROM events WHERE job = ? ORDER BY block_number, event_id", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var result []testRow
+	for rows.Next() {
+		var r testRow
+		if err := rows.Scan(&r.BlockNumber, &r.TxHash, &r.EventID, &r.Failed); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSqliteOutput(t *testing.T) {
+	rows := []testRow{
+		{BlockNumber: 1, TxHash: "0x01", EventID: 0},
+		{BlockNumber: 1, TxHash: "0x01", EventID: 1},
+		{BlockNumber: 2, TxHash: "0x02"},
+		{BlockNumber: 3, TxHash: "0x03"},
+	}
+	forked := testRow{BlockNumber: 2, TxHash: "0x0f"}
+
+	tests := []struct {
+		name string
+		runs [][]any
+		want []testRow
+	}{
+		{
+			name: "rows",
+			runs: [][]any{{rows[0], rows[1], checkpointMsg(1), rows[2], rows[3], checkpointMsg(3)}},
+			want: rows,
+		},
+		{
+			name: "upsert",
+			runs: [][]any{{rows[0], rows[1], checkpointMsg(1), testRow{BlockNumber: 1, TxHash: "0x01", EventID: 1, Failed: true}, checkpointMsg(1)}},
+			want: []testRow{rows[0], {BlockNumber: 1, TxHash: "0x01", EventID: 1, Failed: true}},
+		},
+		{
+			name: "rewind committed rows",
+			runs: [][]any{{
+				rows[0], rows[1], checkpointMsg(1), rows[2], checkpointMsg(2), rows[3], checkpointMsg(3),
+				rewindTo(1), forked, checkpointMsg(2),
+			}},
+			want: []testRow{rows[0], rows[1], forked},
+		},
+		{
+			name: "rewind pending rows",
+			runs: [][]any{{rows[0], rows[1], checkpointMsg(1), rows[2], rewindTo(1), forked, checkpointMsg(2)}},
+			want: []testRow{rows[0], rows[1], forked},
+		},
+		{
+			name: "resume",
+			runs: [][]any{
+				{rows[0], rows[1], checkpointMsg(1), rows[2]},
+				{rows[2], checkpointMsg(2), rows[3], checkpointMsg(3)},
+			},
+			want: rows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.db")
+			for _, steps := range tt.runs {
+				runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatSQLite}, steps...)
+			}
+
+			if got := readSqliteRows(t, path, ""); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSqliteOutputSharedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	rows := []testRow{{BlockNumber: 1, TxHash: "0x01"}, {BlockNumber: 2, TxHash: "0x02"}}
+	runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatSQLite, Job: "a"},
+		rows[0], checkpointMsg(1), rows[1], checkpointMsg(2))
+	// the same rows of another job are kept apart and its rewind leaves the first job alone
+	runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatSQLite, Job: "b"},
+		rows[0], checkpointMsg(1), rows[1], checkpointMsg(2), rewindTo(1))
+
+	if got := readSqliteRows(t, path, "a"); !reflect.DeepEqual(got, rows) {
+		t.Errorf("rows of job a = %+v, want %+v", got, rows)
+	}
+	if got := readSqliteRows(t, path, "b"); !reflect.DeepEqual(got, rows[:1]) {
+		t.Errorf("rows of job b = %+v, want %+v", got, rows[:1])
+	}
+}
+
+func TestSqliteOutputColumnsChanged(t *testing.T) {
+	type otherRow struct {
+		BlockNumber uint64 `csv:"block_number"`
+		TxHash      string `csv:"tx_hash"`
+		EventID     uint16 `csv:"event_id"`
+		Value       string `csv:"value"`
+	}
+
+	path := filepath.Join(t.TempDir(), "out.db")
+	runOutput(t, OutputConfig{FilePath: path, Format: OutputFormatSQLite}, testRow{BlockNumber: 1}, checkpointMsg(1))
+
+	if _, err := newSqliteSink(&OutputConfig{FilePath: path, InType: otherRow{}}); err == nil {
+		t.Fatal("rows with other columns are written to the events table")
+	}
+
+	s, err := newSqliteSink(&OutputConfig{FilePath: path, InType: testRow{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSqliteTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	tokens, err := loadSqliteTokens(path)
+	if err != nil || len(tokens) != 0 {
+		t.Fatalf("loadSqliteTokens() = %v, %v", tokens, err)
+	}
+
+	want := []tokenInfo{{Address: "0x01", Symbol: "A", Decimals: 6}, {Address: "0x02", Symbol: "B", Decimals: 18}}
+	if err := saveSqliteTokens(path, want); err != nil {
+		t.Fatal(err)
+	}
+	want[0].Symbol = "C"
+	if err := saveSqliteTokens(path, want[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err = loadSqliteTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("loadSqliteTokens() = %+v, want %+v", tokens, want)
+	}
+}
@@ -1,37 +1,57 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"collector/smartcontract/erc20"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	log "github.com/sirupsen/logrus"
 )
 
-const tokensFilePath = "./.data/tokens.json"
+const tokensFileName = "tokens.json"
+
+func (c *collectorService) tokensFilePath() string {
+	return filepath.Join(c.dataDir, tokensFileName)
+}
 
 func (c *collectorService) initTokensInfo() error {
 	c.tokens = make(map[string]tokenInfo)
 
-	data, err := os.ReadFile(tokensFilePath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
+	var info []tokenInfo
+	if c.outputFormat == OutputFormatSQLite {
+		var err error
+		if info, err = loadSqliteTokens(c.outputFilePath); err != nil {
+			return fmt.Errorf("load tokens: %w", err)
+		}
+	} else {
+		data, err := os.ReadFile(c.tokensFilePath())
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return fmt.Errorf("read data file %s: %w", c.tokensFilePath(), err)
 		}
-		return fmt.Errorf("read data file %s: %w", tokensFilePath, err)
-	}
 
-	var info []tokenInfo
-	if err := json.Unmarshal(data, &info); err != nil {
-		return fmt.Errorf("unmarshal json: %w", err)
+		if err := json.Unmarshal(data, &info); err != nil {
+			return fmt.Errorf("unmarshal json: %w", err)
+		}
 	}
 
 	c.mu.Lock()
 	for _, i := range info {
+		if i.Multiplier > 0 {
+			for m := i.Multiplier; m >= 10; m /= 10 {
+				i.Decimals++
+			}
+			i.Multiplier = 0
+		}
 		c.tokens[i.Address] = i
 	}
 	c.mu.Unlock()
@@ -48,26 +68,37 @@ func (c *collectorService) getTokenInfo(address string) (tokenInfo, error) {
 		return info, nil
 	}
 
-	token, err := erc20.NewErc20(common.HexToAddress(address), c.cli)
-	if err != nil {
-		return tokenInfo{}, fmt.Errorf("bint token %s: %w", address, err)
-	}
-
-	symbol, err := token.Symbol(nil)
+	var symbol string
+	err := c.call("get token symbol "+address, func(ctx context.Context, e *endpoint) (err error) {
+		token, err := erc20.NewErc20Caller(common.HexToAddress(address), e.cli)
+		if err != nil {
+			return fmt.Errorf("bind token: %w", err)
+		}
+		symbol, err = token.Symbol(&bind.CallOpts{Context: ctx})
+		return err
+	})
 	if err != nil {
 		return tokenInfo{}, fmt.Errorf("get token symbol %s: %w", address, err)
 	}
 
-	decimals, err := token.Decimals(nil)
+	var decimals uint8
+	err = c.call("get token decimals "+address, func(ctx context.Context, e *endpoint) (err error) {
+		token, err := erc20.NewErc20Caller(common.HexToAddress(address), e.cli)
+		if err != nil {
+			return fmt.Errorf("bind token: %w", err)
+		}
+		decimals, err = token.Decimals(&bind.CallOpts{Context: ctx})
+		return err
+	})
 	if err != nil {
 		log.WithError(err).WithField("token", address).Error("get token decimals")
 		decimals = 18
 	}
 
 	info = tokenInfo{
-		Address:    address,
-		Symbol:     symbol,
-		Multiplier: uint64(Pow(10, decimals)),
+		Address:  address,
+		Symbol:   symbol,
+		Decimals: decimals,
 	}
 
 	c.mu.Lock()
@@ -85,13 +116,20 @@ func (c *collectorService) saveTokensInfo() error {
 	}
 	c.mu.RUnlock()
 
+	if c.outputFormat == OutputFormatSQLite {
+		return saveSqliteTokens(c.outputFilePath, info)
+	}
+
 	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("marshal json: %w", err)
 	}
 
-	if err := os.WriteFile(tokensFilePath, data, 0o644); err != nil {
-		return fmt.Errorf("write file %s: %w", tokensFilePath, err)
+	if err := os.MkdirAll(c.dataDir, os.ModePerm); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+	if err := os.WriteFile(c.tokensFilePath(), data, 0o644); err != nil {
+		return fmt.Errorf("write file %s: %w", c.tokensFilePath(), err)
 	}
 
 	return nil
@@ -1,12 +1,12 @@
 package collector
 
 import (
-	"context"
 	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,44 +17,118 @@ type TransactionInfo struct {
 	Receiver    string `csv:"receiver"`
 	BlockNumber uint64 `csv:"block_number"`
 	Timestamp   uint64 `csv:"timestamp"`
+	Watched     string `csv:"watched"`
+	// CreatedContract is set for contract creation txs, Receiver is empty then.
+	CreatedContract string `csv:"created_contract"`
+	// Value, prices and fees are in wei.
+	Value             string `csv:"value"`
+	GasLimit          uint64 `csv:"gas_limit"`
+	GasUsed           uint64 `csv:"gas_used"`
+	EffectiveGasPrice string `csv:"effective_gas_price"`
+	Fee               string `csv:"fee"`
+	BaseFee           string `csv:"base_fee"`
+	PriorityFee       string `csv:"priority_fee"`
+	TxType            uint8  `csv:"tx_type"`
+	// Status is 1 for successful txs and 0 for failed ones.
+	Status uint64 `csv:"status"`
 }
 
+// checkpointInterval is the number of blocks between checkpoints in the txs mode.
+const checkpointInterval = 100
+
 func (c *collectorService) collectAllTxs() error {
 	log.WithField("from_block", c.fromBlock).
 		WithField("to_block", c.toBlock).
-		WithField("address", c.address).
+		WithField("addresses", c.addresses).
+		WithField("workers", c.workers).
 		Info("collect txs")
 
-	blockNum := new(big.Int).Set(c.fromBlock)
-	for blockNum.Cmp(c.toBlock) <= 0 {
+	blockNum := c.fromBlock.Uint64()
+	defer func() {
+		// blockNum is the first block that is not collected yet
+		if blockNum > c.fromBlock.Uint64() {
+			c.msgChan <- checkpointMsg(blockNum - 1)
+		}
+	}()
+
+	for blockNum <= c.toBlock.Uint64() {
+		next, err := c.collectBlocks(blockNum, c.toBlock.Uint64())
+		blockNum = next
+		if err != nil {
+			return err
+		}
 
-		select {
-		case <-c.exitChan:
+		if c.stopped() {
 			return nil
-		default:
 		}
+	}
+
+	return nil
+}
+
+// collectBlocks returns the first block that is not collected yet. It returns before
+// reaching the block "to" if the program is stopped or the chain is reorganized.
+func (c *collectorService) collectBlocks(from, to uint64) (uint64, error) {
+	blocks, stop := c.fetchBlocks(from, to)
+	defer stop()
+
+	blockNum := from
+	for res := range blocks {
+		if c.stopped() {
+			return blockNum, nil
+		}
+
+		if res.err != nil {
+			return blockNum, fmt.Errorf("get block %d: %w", res.num, res.err)
+		}
+		block := res.block
 
-		block, err := c.cli.BlockByNumber(context.Background(), blockNum)
+		next, reorg, err := c.checkReorg(block.Header())
 		if err != nil {
-			return fmt.Errorf("get block %d: %w", blockNum, err)
+			return blockNum, fmt.Errorf("check reorg at block %d: %w", res.num, err)
+		}
+		if reorg {
+			return next, nil
 		}
 
+		var (
+			txs     []*types.Transaction
+			senders []common.Address
+		)
 		for _, tx := range block.Transactions() {
 			sender := c.txSender(tx)
-			if (tx.To() != nil && *tx.To() == c.address) || sender == c.address {
+			if c.isWatched(sender) || c.isWatched(txReceiver(tx, sender)) {
+				txs = append(txs, tx)
+				senders = append(senders, sender)
+			}
+		}
+
+		if len(txs) > 0 {
+			receipts, err := c.receipts(block, txs)
+			if err != nil {
+				return blockNum, err
+			}
+
+			for i, tx := range txs {
 				c.msgChan <- &TxWrapper{
 					Tx:          tx,
-					Sender:      sender,
+					Sender:      senders[i],
 					BlockNumber: block.NumberU64(),
 					Timestamp:   block.Time(),
+					BaseFee:     block.BaseFee(),
+					Receipt:     receipts[tx.Hash()],
 				}
 			}
 		}
 
-		blockNum.Add(blockNum, common.Big1)
+		if (blockNum+1)%checkpointInterval == 0 {
+			c.msgChan <- checkpointMsg(blockNum)
+		}
+
+		blockNum++
 	}
 
-	return nil
+	return blockNum, nil
 }
 
 type TxWrapper struct {
@@ -62,22 +136,62 @@ type TxWrapper struct {
 	Sender      common.Address
 	BlockNumber uint64
 	Timestamp   uint64
+	// BaseFee is nil before the London fork
+	BaseFee *big.Int
+	Receipt *types.Receipt
 }
 
 func (c *collectorService) convertToTxInfo(w *TxWrapper) (TransactionInfo, bool) {
-	return TransactionInfo{
+	info := TransactionInfo{
 		TxHash:      w.Tx.Hash().Hex(),
 		Nonce:       w.Tx.Nonce(),
 		Sender:      w.Sender.Hex(),
-		Receiver:    w.Tx.To().Hex(),
 		BlockNumber: w.BlockNumber,
 		Timestamp:   w.Timestamp,
-	}, true
+		Watched:     c.matchedAddresses(w.Sender, txReceiver(w.Tx, w.Sender)),
+		Value:       w.Tx.Value().String(),
+		GasLimit:    w.Tx.Gas(),
+		TxType:      w.Tx.Type(),
+	}
+
+	if w.Tx.To() != nil {
+		info.Receiver = w.Tx.To().Hex()
+	} else if w.Receipt != nil {
+		info.CreatedContract = w.Receipt.ContractAddress.Hex()
+	}
+
+	if w.BaseFee != nil {
+		info.BaseFee = w.BaseFee.String()
+	}
+
+	if w.Receipt == nil {
+		// receipts are fetched with the block, a tx without one is never written
+		log.WithField("tx_hash", info.TxHash).Error("no tx receipt")
+		return info, false
+	}
+
+	price := effectiveGasPrice(w.Tx, w.Receipt, w.BaseFee)
+	info.GasUsed = w.Receipt.GasUsed
+	info.Status = w.Receipt.Status
+	info.EffectiveGasPrice = price.String()
+	info.Fee = new(big.Int).Mul(price, new(big.Int).SetUint64(w.Receipt.GasUsed)).String()
+	if w.BaseFee != nil {
+		info.PriorityFee = new(big.Int).Sub(price, w.BaseFee).String()
+	}
+
+	return info, true
+}
+
+// txReceiver returns the recipient of the tx or the address of the contract it creates.
+func txReceiver(tx *types.Transaction, sender common.Address) common.Address {
+	if tx.To() != nil {
+		return *tx.To()
+	}
+	return crypto.CreateAddress(sender, tx.Nonce())
 }
 
 func (c *collectorService) txSender(tx *types.Transaction) common.Address {
-	signer := types.LatestSignerForChainID(tx.ChainId())
-	sender, err := signer.Sender(tx)
+	sender, err := c.signer.Sender(tx)
 	if err != nil {
 		log.WithError(err).
 			WithField("tx_hash", tx.Hash().Hex()).
@@ -1,9 +1,7 @@
 package collector
 
 import (
-	"context"
 	"fmt"
-	"math/big"
 
 	"collector/smartcontract/erc20"
 
@@ -15,58 +13,95 @@ import (
 )
 
 type TransferInfo struct {
-	Token           string  `csv:"token"`
-	Symbol          string  `csv:"symbol"`
-	From            string  `csv:"from"`
-	To              string  `csv:"to"`
-	Value           uint64  `csv:"value"`
-	NormalizedValue float64 `csv:"normalized_value"`
-	TxHash          string  `csv:"tx_hash"`
-	BlockNumber     uint64  `csv:"block_number"`
-	EventID         uint16  `csv:"event_id"`
+	Token           string `csv:"token"`
+	Symbol          string `csv:"symbol"`
+	From            string `csv:"from"`
+	To              string `csv:"to"`
+	Value           string `csv:"value"`
+	NormalizedValue string `csv:"normalized_value"`
+	TxHash          string `csv:"tx_hash"`
+	BlockNumber     uint64 `csv:"block_number"`
+	EventID         uint16 `csv:"event_id"`
+	Watched         string `csv:"watched"`
+	// Kind tells token transfers from native and internal ones, EventID is only set for tokens.
+	Kind string `csv:"kind"`
+	// TracePath is the position of the call in the call tree of an internal transfer.
+	TracePath string `csv:"trace_path"`
 }
 
+const (
+	transferKindToken  = "token"
+	transferKindNative = "native"
+)
+
 func (c *collectorService) collectTransfers() error {
 	log.WithField("from_block", c.fromBlock).
 		WithField("to_block", c.toBlock).
-		WithField("address", c.address).
+		WithField("addresses", c.addresses).
 		Info("collect transfers")
 
+	return c.collectRanges(c.transfersFetcher())
+}
+
+// transfersFetcher returns the fetch function of collectRanges for transfers of the watched addresses.
+func (c *collectorService) transfersFetcher() func(q ethereum.FilterQuery) ([]any, int, error) {
 	var (
 		transferTopic = c.abi.Events["Transfer"].ID
-		topics        = [2][][]common.Hash{
-			{{transferTopic}, {c.address.Hash()}},     // from "c.address"
-			{{transferTopic}, {}, {c.address.Hash()}}, // to "c.address"
-		}
+		queries       []logsQuery
 	)
+	for _, batch := range c.addressBatches() {
+		queries = append(queries,
+			logsQuery{topics: [][]common.Hash{{transferTopic}, batch}},                     // from watched addresses
+			logsQuery{topics: [][]common.Hash{{transferTopic}, {}, batch}, senderTopic: 1}, // to watched addresses
+		)
+	}
 
-	q := ethereum.FilterQuery{ToBlock: new(big.Int).Set(c.fromBlock)}
-	updateQuery(&q, c.toBlock)
-
-	for q.FromBlock.Cmp(c.toBlock) < 0 {
-		for _, tops := range topics {
+	return func(q ethereum.FilterQuery) ([]any, int, error) {
+		events, err := c.filterLogs(q, queries)
+		if err != nil || c.stopped() {
+			return nil, 0, err
+		}
 
-			select {
-			case <-c.exitChan:
-				return nil
-			default:
+		// ERC-721 transfers have the same signature but the token id is indexed
+		tokenEvents := events[:0]
+		for _, event := range events {
+			if len(event.Topics) == 3 {
+				tokenEvents = append(tokenEvents, event)
 			}
+		}
 
-			q.Topics = tops
-			events, err := c.cli.FilterLogs(context.Background(), q)
+		var natives []*NativeTransfer
+		if c.nativeTransfersOn {
+			natives, err = c.nativeTransfers(q.FromBlock.Uint64(), q.ToBlock.Uint64())
 			if err != nil {
-				return fmt.Errorf("filter logs from %d to %d: %w", q.FromBlock, q.ToBlock, err)
+				return nil, 0, fmt.Errorf("native transfers: %w", err)
 			}
+		}
 
-			for _, event := range events {
-				c.msgChan <- event
+		var internals []*InternalTransfer
+		if c.internalTransfersOn {
+			internals, err = c.internalTransfers(q.FromBlock.Uint64(), q.ToBlock.Uint64())
+			if err != nil {
+				return nil, 0, fmt.Errorf("internal transfers: %w", err)
 			}
 		}
 
-		updateQuery(&q, c.toBlock)
+		return sortTransfers(tokenEvents, natives, internals), len(events), nil
 	}
+}
 
-	return nil
+func (c *collectorService) convertTransfer(val any) (TransferInfo, bool) {
+	switch t := val.(type) {
+	case types.Log:
+		return c.convertToTransferInfo(t)
+	case *NativeTransfer:
+		return c.convertNativeTransfer(t)
+	case *InternalTransfer:
+		return c.convertInternalTransfer(t)
+	default:
+		log.WithField("type", fmt.Sprintf("%T", val)).Error("unexpected transfer type")
+		return TransferInfo{}, false
+	}
 }
 
 func (c *collectorService) convertToTransferInfo(eventRaw types.Log) (TransferInfo, bool) {
@@ -92,11 +127,13 @@ func (c *collectorService) convertToTransferInfo(eventRaw types.Log) (TransferIn
 		Symbol:          token.Symbol,
 		From:            event.Src.Hex(),
 		To:              event.Dst.Hex(),
-		Value:           event.Wad.Uint64(),
-		NormalizedValue: Normalize(event.Wad, token.Multiplier),
+		Value:           event.Wad.String(),
+		NormalizedValue: Normalize(event.Wad, token.Decimals),
 		TxHash:          eventRaw.TxHash.Hex(),
 		BlockNumber:     eventRaw.BlockNumber,
 		EventID:         uint16(eventRaw.Index),
+		Watched:         c.matchedAddresses(event.Src, event.Dst),
+		Kind:            transferKindToken,
 	}, true
 }
 
@@ -121,17 +158,3 @@ func parseTransferEvent(ABI *abi.ABI, event *types.Log) (*erc20.Erc20Transfer, e
 
 	return &transfer, nil
 }
-
-func updateQuery(q *ethereum.FilterQuery, maxBlock *big.Int) {
-	batchSize := big.NewInt(1000) // const
-
-	q.FromBlock = q.ToBlock
-	q.ToBlock = minBigInt(new(big.Int).Add(q.ToBlock, batchSize), maxBlock)
-}
-
-func minBigInt(a, b *big.Int) *big.Int {
-	if a.Cmp(b) < 0 {
-		return a
-	}
-	return b
-}
@@ -1,18 +1,43 @@
 package collector
 
 import (
-	"math"
 	"math/big"
-
-	"golang.org/x/exp/constraints"
+	"strings"
 )
 
-func Pow[A, B constraints.Integer | constraints.Float](x A, n B) float64 {
-	return math.Pow(float64(x), float64(n))
+// Normalize formats the raw token amount as an exact decimal number with the token decimals.
+func Normalize(value *big.Int, decimals uint8) string {
+	s := new(big.Int).Abs(value).String()
+
+	if decimals > 0 {
+		d := int(decimals)
+		if len(s) <= d {
+			s = strings.Repeat("0", d-len(s)+1) + s
+		}
+		s = s[:len(s)-d] + "." + s[len(s)-d:]
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+
+	if value.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
-func Normalize(value *big.Int, multiplier uint64) float64 {
-	bigF := new(big.Float).SetInt(value)
-	f, _ := bigF.Quo(bigF, big.NewFloat(float64(multiplier))).Float64()
-	return f
+func containsInt(values []int, n int) bool {
+	for _, v := range values {
+		if v == n {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,37 @@
+package collector
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+
+	tests := []struct {
+		value    *big.Int
+		decimals uint8
+		want     string
+	}{
+		{value: big.NewInt(0), decimals: 18, want: "0"},
+		{value: big.NewInt(0), decimals: 0, want: "0"},
+		{value: big.NewInt(42), decimals: 0, want: "42"},
+		{value: big.NewInt(1), decimals: 18, want: "0.000000000000000001"},
+		{value: big.NewInt(1_000_000), decimals: 6, want: "1"},
+		{value: big.NewInt(1_500_000), decimals: 6, want: "1.5"},
+		{value: big.NewInt(1_234_567), decimals: 6, want: "1.234567"},
+		{value: big.NewInt(100), decimals: 2, want: "1"},
+		{value: big.NewInt(1000), decimals: 2, want: "10"},
+		{value: big.NewInt(-1_500_000), decimals: 6, want: "-1.5"},
+		{value: big.NewInt(-1), decimals: 3, want: "-0.001"},
+		{value: huge, decimals: 18, want: "123456789012.34567890123456789"},
+		{value: new(big.Int).Lsh(big.NewInt(1), 64), decimals: 18, want: "18.446744073709551616"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := Normalize(tt.value, tt.decimals); got != tt.want {
+				t.Errorf("Normalize(%s, %d) = %s, want %s", tt.value, tt.decimals, got, tt.want)
+			}
+		})
+	}
+}
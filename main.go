@@ -12,18 +12,46 @@ import (
 )
 
 func main() {
-	cfg := buildConfig()
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		snapshot(os.Args[2:])
+		return
+	}
+
+	cfgPath := flag.String("config", "./config.yaml", "config path")
+	flag.Parse()
+
+	cfg := buildConfig(*cfgPath)
 	if err := collector.Run(cfg); err != nil {
 		log.WithError(err).Panic("program failed")
 	}
 }
 
-func buildConfig() collector.Config {
-	cfgPath := flag.String("config", "./config.yaml", "config path")
+// snapshot writes the portfolio of an address at a block:
+//
+//	xcollector snapshot --config=config.yaml --address=0x... --block=18000000
+func snapshot(args []string) {
+	var (
+		flags       = flag.NewFlagSet("snapshot", flag.ExitOnError)
+		cfgPath     = flags.String("config", "./config.yaml", "config path")
+		snapshotCfg collector.SnapshotConfig
+	)
+	flags.StringVar(&snapshotCfg.Address, "address", "", "address of the holder")
+	flags.Int64Var(&snapshotCfg.Block, "block", -1, "block number, the latest confirmed block by default")
+	flags.Int64Var(&snapshotCfg.Timestamp, "timestamp", -1, "unix time, the last block mined at or before it is used, can't be combined with --block")
+	flags.BoolVar(&snapshotCfg.Discover, "discover", false, "discover tokens from transfers of the address")
+	flags.StringVar(&snapshotCfg.OutputFilePath, "output", "./snapshot.csv", "output file path, written as JSON Lines if it ends with .jsonl")
+	_ = flags.Parse(args)
+
+	cfg := buildConfig(*cfgPath)
+	if err := collector.Snapshot(cfg, snapshotCfg); err != nil {
+		log.WithError(err).Panic("snapshot failed")
+	}
+}
 
+func buildConfig(cfgPath string) collector.Config {
 	var cfg collector.Config
-	if err := parseConfigFromFile(*cfgPath, &cfg); err != nil {
-		log.WithError(err).WithField("path", *cfgPath).Panic("invalid config")
+	if err := parseConfigFromFile(cfgPath, &cfg); err != nil {
+		log.WithError(err).WithField("path", cfgPath).Panic("invalid config")
 	}
 
 	return cfg